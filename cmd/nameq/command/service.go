@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/ninchat/nameq/service"
 )
@@ -14,6 +16,15 @@ func serve(prog, command string) (err error) {
 	p := service.DefaultParams()
 
 	var (
+		altAddrs   string
+		tlsPeers   string
+		multicast  bool
+		groups     = service.DefaultMulticastGroup4 + "," + service.DefaultMulticastGroup6
+		policy     = "address"
+		layout     = "ip"
+		labels     string
+		apiMode    = fmt.Sprintf("%o", service.DefaultAPISocketMode)
+		apiUids    string
 		secretFile string
 		secretFd   int = -1
 		s3CredFile string
@@ -28,18 +39,60 @@ func serve(prog, command string) (err error) {
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 		fmt.Fprintln(os.Stderr, "")
-		fmt.Fprintf(os.Stderr, "The local IP address is guessed if not specified.  The guess may be wrong.\n\n")
+		fmt.Fprintf(os.Stderr, "The local IP address is guessed if not specified.  The guess may be wrong.  IPv4 and IPv6 addresses are supported; a dual-stack host may specify an address of the other family via -altaddrs.\n\n")
 		fmt.Fprintf(os.Stderr, "The command-line features specification is a JSON document like this: {\"feature1\":true,\"feature2\":10}\n\n")
 		fmt.Fprintf(os.Stderr, "The AWS credentials file should contain two lines of text: an access key id and a secret access key.  They may also be specified via the AWS_ACCESS_KEY and AWS_SECRET_KEY environment variables.\n\n")
-		fmt.Fprintf(os.Stderr, "The secret peer-to-peer messaging key is used with HMAC-SHA1.\n\n")
+		fmt.Fprintf(os.Stderr, "The secret peer-to-peer messaging key is used with HMAC-SHA256, or with HMAC-SHA1 when talking to nodes which support only the original protocol.\n\n")
+		fmt.Fprintf(os.Stderr, "The advertised address and port (-addr and -port) may differ from the bound ones when running behind NAT, e.g. in a container.  By default, messages must originate from the advertised address; -originpolicy=signature relaxes it for nodes which sign their messages (-keyfile).\n\n")
+		fmt.Fprintf(os.Stderr, "The TLS transport (-tlscert, -tlskey and -tlsca) carries messages over mutually authenticated TCP connections.  It is used with nodes in the -tlspeers networks which also have it enabled, e.g. -tlspeers=0.0.0.0/0,::/0 for all nodes.  Peer certificates must be issued by the CA; their names are not checked.\n\n")
+		fmt.Fprintf(os.Stderr, "In multicast mode (-multicast), nodes announce themselves to multicast groups and discover each other without S3 on a local network.  S3 is optional in that mode.  Groups of an address family without a local address are ignored.\n\n")
+		fmt.Fprintf(os.Stderr, "Each node has a persistent id (-idfile), which distinguishes a replaced host from its predecessor at the same address, and follows a host whose address changes.  If the file can't be created, the id changes when the service restarts.  The state directory names hosts by id with -statelayout=id.\n\n")
+		fmt.Fprintf(os.Stderr, "The control socket (-apisocket) accepts JSON requests, one per line: {\"op\":\"nodes\"}, {\"op\":\"features\"}, {\"op\":\"subscribe\"}, {\"op\":\"set\",\"name\":\"feature1\",\"value\":true}, {\"op\":\"remove\",\"name\":\"feature1\"} or {\"op\":\"resync\"}.  Changes are allowed for root, the service's user and the -apiuids users.\n\n")
+		fmt.Fprintf(os.Stderr, "The HTTP API (-httpport) serves /features, /features/NAME, /nodes and /health as JSON, and /events as a server-sent event stream.  It is bound to localhost unless -httpaddr is specified.\n\n")
+		fmt.Fprintf(os.Stderr, "The DNS server (-dnsport) answers A and AAAA queries for FEATURE.nameq with the addresses of the hosts which provide the feature.  SRV queries for FEATURE.nameq or _FEATURE._tcp.nameq are answered if the feature value is an object with a \"port\" number.\n\n")
 		fmt.Fprintf(os.Stderr, "Log messages are written to stderr unless syslog is enabled.\n\n")
 	}
 
 	flag.StringVar(&p.Addr, "addr", p.Addr, "local IP address for peer-to-peer messaging")
+	flag.StringVar(&altAddrs, "altaddrs", altAddrs, "comma-separated alternative local IP addresses (dual-stack)")
 	flag.IntVar(&p.Port, "port", p.Port, "UDP port for peer-to-peer messaging")
+	flag.StringVar(&p.BindAddr, "bindaddr", p.BindAddr, "local IP address for receiving peer-to-peer messages (defaults to -addr)")
+	flag.IntVar(&p.BindPort, "bindport", p.BindPort, "UDP port for receiving peer-to-peer messages (defaults to -port)")
+	flag.StringVar(&policy, "originpolicy", policy, "peer-to-peer message origin verification (\"address\", \"signature\" or \"any\")")
+	flag.IntVar(&p.GossipFanout, "gossip", p.GossipFanout, "relay other nodes' signed states to this many random nodes (0 disables gossip)")
+	flag.BoolVar(&p.ScalableFanout, "scalable", p.ScalableFanout, "transmit to a logarithmic number of random nodes per round instead of all nodes (requires -keyfile)")
+	flag.StringVar(&p.KeyFile, "keyfile", p.KeyFile, "path for the node's signing key (created if necessary)")
+	flag.StringVar(&p.TLSCertFile, "tlscert", p.TLSCertFile, "path for reading TLS certificate (enables TLS transport)")
+	flag.StringVar(&p.TLSKeyFile, "tlskey", p.TLSKeyFile, "path for reading TLS private key")
+	flag.StringVar(&p.TLSCAFile, "tlsca", p.TLSCAFile, "path for reading CA certificates which issue peer certificates")
+	flag.IntVar(&p.TLSPort, "tlsport", p.TLSPort, "TCP port for TLS messaging (defaults to -port)")
+	flag.IntVar(&p.TLSBindPort, "tlsbindport", p.TLSBindPort, "TCP port for accepting TLS connections (defaults to -tlsport)")
+	flag.StringVar(&tlsPeers, "tlspeers", tlsPeers, "comma-separated networks of nodes which are contacted using TLS (CIDR notation)")
+	flag.BoolVar(&multicast, "multicast", multicast, "discover nodes on the local network via multicast")
+	flag.StringVar(&groups, "multicastgroups", groups, "comma-separated multicast group addresses")
+	flag.IntVar(&p.MulticastPort, "multicastport", p.MulticastPort, "UDP port for multicast discovery")
+	flag.BoolVar(&p.FailureDetection, "failuredetection", p.FailureDetection, "probe other nodes in order to detect crashes quickly")
+	flag.DurationVar(&p.SuspectGrace, "suspectgrace", p.SuspectGrace, "keep features of unresponsive nodes visible for this long")
+	flag.DurationVar(&p.FlapHalfLife, "flaphalflife", p.FlapHalfLife, "half-life of the flap damping penalty (0 disables damping)")
+	flag.StringVar(&labels, "labels", labels, "comma-separated static attributes of the node (e.g. region=eu,zone=eu-1a,rack=r1,role=db)")
 	flag.StringVar(&p.Features, "features", p.Features, "features (JSON)")
 	flag.StringVar(&p.FeatureDir, "featuredir", p.FeatureDir, "dynamic feature configuration location")
+	flag.DurationVar(&p.ConfigWindow, "configwindow", p.ConfigWindow, "coalesce feature configuration changes which occur within this time (0 disables)")
+	flag.DurationVar(&p.NotifyWindow, "notifywindow", p.NotifyWindow, "coalesce transmissions and S3 writes caused by local changes within this time (0 disables)")
 	flag.StringVar(&p.StateDir, "statedir", p.StateDir, "runtime state root location")
+	flag.StringVar(&layout, "statelayout", layout, "name hosts in the state directory by \"ip\" address or node \"id\"")
+	flag.BoolVar(&p.HostView, "hostview", p.HostView, "also write features grouped by host to the state directory")
+	flag.StringVar(&p.IdFile, "idfile", p.IdFile, "path for the persistent node id (created if necessary); the last sequence number is saved next to it")
+	flag.StringVar(&p.APISocket, "apisocket", p.APISocket, "path for the control socket (enables the API)")
+	flag.StringVar(&apiMode, "apisocketmode", apiMode, "file mode of the control socket (octal)")
+	flag.StringVar(&apiUids, "apiuids", apiUids, "comma-separated ids of users which may make changes via the control socket")
+	flag.IntVar(&p.HTTPPort, "httpport", p.HTTPPort, "TCP port for the read-only HTTP API (0 disables)")
+	flag.StringVar(&p.HTTPBindAddr, "httpaddr", p.HTTPBindAddr, "local IP address for the HTTP API")
+	flag.IntVar(&p.DNSPort, "dnsport", p.DNSPort, "UDP and TCP port for the DNS server (0 disables)")
+	flag.StringVar(&p.DNSBindAddr, "dnsaddr", p.DNSBindAddr, "local IP address for the DNS server")
+	flag.StringVar(&p.DNSDomain, "dnsdomain", p.DNSDomain, "domain of the names in DNS and in the hosts file")
+	flag.BoolVar(&p.HostsFile, "hostsfile", p.HostsFile, "write names of hosts to a file in the hosts format in the state directory")
+	flag.DurationVar(&p.DNSTTL, "dnsttl", p.DNSTTL, "time-to-live of DNS records")
 	flag.StringVar(&secretFile, "secretfile", secretFile, "path for reading peer-to-peer messaging key")
 	flag.IntVar(&secretFd, "secretfd", secretFd, "file descriptor for reading peer-to-peer messaging key")
 	flag.StringVar(&s3CredFile, "s3credfile", s3CredFile, "path for reading AWS credentials")
@@ -53,11 +106,67 @@ func serve(prog, command string) (err error) {
 
 	flag.Parse()
 
-	if p.Addr == "" || ((secretFile == "") == (secretFd < 0)) || (s3CredFile != "" && s3CredFd >= 0) || p.S3Region == "" || p.S3Bucket == "" {
+	if p.Addr == "" || ((secretFile == "") == (secretFd < 0)) || (s3CredFile != "" && s3CredFd >= 0) || (!multicast && (p.S3Region == "" || p.S3Bucket == "")) {
 		flag.Usage()
 		os.Exit(2)
 	}
 
+	if p.OriginPolicy, err = service.ParseOriginPolicy(policy); err != nil {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if p.StateLayout, err = service.ParseStateLayout(layout); err != nil {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if labels != "" {
+		if p.Labels, err = service.ParseLabels(labels); err != nil {
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
+	if mode, err := strconv.ParseUint(apiMode, 8, 32); err == nil {
+		p.APISocketMode = os.FileMode(mode)
+	} else {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if apiUids != "" {
+		for _, s := range strings.Split(apiUids, ",") {
+			uid, err := strconv.Atoi(s)
+			if err != nil {
+				flag.Usage()
+				os.Exit(2)
+			}
+			p.APIUids = append(p.APIUids, uid)
+		}
+	}
+
+	if altAddrs != "" {
+		p.AltAddrs = strings.Split(altAddrs, ",")
+	}
+
+	if p.TLSCertFile != "" && (p.TLSKeyFile == "" || p.TLSCAFile == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if tlsPeers != "" {
+		p.TLSPeers = strings.Split(tlsPeers, ",")
+	}
+
+	if multicast {
+		p.MulticastGroups = strings.Split(groups, ",")
+
+		if p.S3Region == "" || p.S3Bucket == "" {
+			p.S3DryRun = true
+		}
+	}
+
 	err = p.Log.DefaultInit(syslogNet, syslogArg, prog, debug)
 	if err != nil {
 		println(err.Error())
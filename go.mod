@@ -5,6 +5,7 @@ go 1.20
 require (
 	github.com/aws/aws-sdk-go v1.42.6
 	github.com/fsnotify/fsnotify v1.5.1
+	golang.org/x/net v0.0.0-20210614182718-04defd469f4e
 )
 
 require (
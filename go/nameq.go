@@ -3,6 +3,7 @@
 package nameq
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net"
 	"os"
@@ -77,11 +78,34 @@ func removeConfigFile(dir, name string) (err error) {
 	return
 }
 
+// HostFeatures reads all features of a host from the host view of the
+// specified state directory, or the default state directory if an empty string
+// is given.  The host is named by its IP address, or node id if the service
+// names hosts by id.  The local host is 127.0.0.1.  nil is returned if the host
+// has no features.
+func HostFeatures(stateDir, host string) (features map[string]json.RawMessage, err error) {
+	if stateDir == "" {
+		stateDir = DefaultStateDir
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(stateDir, "hosts", host+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	err = json.Unmarshal(data, &features)
+	return
+}
+
 // Feature represents a momentary state of a feature on a host.
 type Feature struct {
-	Name string // Name of the feature.
-	Host net.IP // IPv4 or IPv6 address of the host where the feature exists.
-	Data []byte // JSON value if feature added or updated, or nil if removed.
+	Name   string            // Name of the feature.
+	Host   net.IP            // IPv4 or IPv6 address of the host where the feature exists.
+	Data   []byte            // JSON value if feature added or updated, or nil if removed.
+	Labels map[string]string // Static attributes of the host, if it has any.
 }
 
 // String returns the feature name.
@@ -104,21 +128,39 @@ type FeatureMonitor struct {
 	// Client code is free to set this member to nil after it has been closed.
 	Boot <-chan struct{}
 
-	logger  Logger
-	closed  chan struct{}
-	watcher *fsnotify.Watcher
-	queued  []*Feature
+	logger   Logger
+	closed   chan struct{}
+	watcher  *fsnotify.Watcher
+	queued   []*Feature
+	nodeDir  string
+	labelDir string
+	hostView bool
+	ids      map[string]net.IP // Hosts named by node id.
 }
 
 // NewFeatureMonitor watches the specified state directory, or the default
 // state directory if an empty string is given.  The directory must exist.  The
 // logger is used for I/O errors, unless nil.
 func NewFeatureMonitor(stateDir string, logger Logger) (m *FeatureMonitor, err error) {
+	return newMonitor(stateDir, false, logger)
+}
+
+// NewHostMonitor is like NewFeatureMonitor, but it watches the host view of
+// the state directory, which is written if the service is run with the
+// -hostview option.  The features are delivered host by host during boot.
+func NewHostMonitor(stateDir string, logger Logger) (m *FeatureMonitor, err error) {
+	return newMonitor(stateDir, true, logger)
+}
+
+func newMonitor(stateDir string, hostView bool, logger Logger) (m *FeatureMonitor, err error) {
 	if stateDir == "" {
 		stateDir = DefaultStateDir
 	}
 
 	featureDir := filepath.Join(stateDir, "features")
+	if hostView {
+		featureDir = filepath.Join(stateDir, "hosts")
+	}
 
 	if err = os.Mkdir(featureDir, 0755); err != nil {
 		if info, statErr := os.Stat(featureDir); statErr != nil || !info.IsDir() {
@@ -149,16 +191,20 @@ func NewFeatureMonitor(stateDir string, logger Logger) (m *FeatureMonitor, err e
 	boot := make(chan struct{})
 
 	m = &FeatureMonitor{
-		C:       c,
-		Boot:    boot,
-		logger:  logger,
-		closed:  make(chan struct{}, 1),
-		watcher: watcher,
+		C:        c,
+		Boot:     boot,
+		logger:   logger,
+		closed:   make(chan struct{}, 1),
+		watcher:  watcher,
+		nodeDir:  filepath.Join(stateDir, "nodes"),
+		labelDir: filepath.Join(stateDir, "labels"),
+		hostView: hostView,
+		ids:      make(map[string]net.IP),
 	}
 
 	if infos, err := ioutil.ReadDir(featureDir); err == nil {
 		for _, info := range infos {
-			m.addFeature(filepath.Join(featureDir, info.Name()))
+			m.addDir(filepath.Join(featureDir, info.Name()))
 		}
 	} else {
 		m.log(err)
@@ -215,15 +261,14 @@ func (m *FeatureMonitor) watchLoop(c chan<- *Feature, boot chan<- struct{}, feat
 				relName := e.Name[namePrefixLen:]
 				if !strings.ContainsRune(relName, filepath.Separator) {
 					// Second level
-					m.addFeature(e.Name)
+					m.addDir(e.Name)
 				} else {
 					// Deeper level
-					hostname := filepath.Base(e.Name)
 					if e.Op&fsnotify.Create != 0 {
-						m.addHost(hostname, e.Name)
+						m.addHost(e.Name)
 					}
 					if e.Op&fsnotify.Remove != 0 {
-						m.removeHost(hostname, e.Name)
+						m.removeHost(e.Name)
 					}
 				}
 			}
@@ -240,7 +285,13 @@ func (m *FeatureMonitor) watchLoop(c chan<- *Feature, boot chan<- struct{}, feat
 	}
 }
 
-func (m *FeatureMonitor) addFeature(dir string) {
+// addDir starts watching a feature directory, or a host directory in the host
+// view.  Other files (such as the combined host files) are ignored.
+func (m *FeatureMonitor) addDir(dir string) {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return
+	}
+
 	if err := m.watcher.Add(dir); err != nil {
 		m.log(err)
 		return
@@ -253,11 +304,15 @@ func (m *FeatureMonitor) addFeature(dir string) {
 	}
 
 	for _, info := range infos {
-		m.addHost(info.Name(), filepath.Join(dir, info.Name()))
+		m.addHost(filepath.Join(dir, info.Name()))
 	}
 }
 
-func (m *FeatureMonitor) addHost(hostname, path string) {
+func (m *FeatureMonitor) addHost(path string) {
+	name, hostname := m.split(path)
+
+	delete(m.ids, hostname) // The host may have a new address.
+
 	host := m.parseHost(hostname, path)
 	if host == nil {
 		return
@@ -280,13 +335,29 @@ func (m *FeatureMonitor) addHost(hostname, path string) {
 	}
 
 	m.queued = append(m.queued, &Feature{
-		Name: filepath.Base(filepath.Dir(path)),
-		Host: host,
-		Data: data,
+		Name:   name,
+		Host:   host,
+		Data:   data,
+		Labels: m.readLabels(hostname),
 	})
 }
 
-func (m *FeatureMonitor) removeHost(hostname, path string) {
+// readLabels of a host.  The labels are written before the features.
+func (m *FeatureMonitor) readLabels(hostname string) (labels map[string]string) {
+	data, err := ioutil.ReadFile(filepath.Join(m.labelDir, hostname))
+	if err != nil {
+		return
+	}
+
+	if err := json.Unmarshal(data, &labels); err != nil {
+		m.log(err)
+	}
+	return
+}
+
+func (m *FeatureMonitor) removeHost(path string) {
+	name, hostname := m.split(path)
+
 	host := m.parseHost(hostname, path)
 	if host == nil {
 		return
@@ -299,16 +370,47 @@ func (m *FeatureMonitor) removeHost(hostname, path string) {
 	}
 
 	m.queued = append(m.queued, &Feature{
-		Name: filepath.Base(filepath.Dir(path)),
+		Name: name,
 		Host: host,
 	})
 }
 
+// split a path into feature name and host name.
+func (m *FeatureMonitor) split(path string) (name, hostname string) {
+	dir, base := filepath.Base(filepath.Dir(path)), filepath.Base(path)
+
+	if m.hostView {
+		return base, dir
+	}
+
+	return dir, base
+}
+
+// parseHost converts a filename to an address.  If the service names hosts by
+// node id, the address is found in the node state.
 func (m *FeatureMonitor) parseHost(name string, path string) (host net.IP) {
-	if host = net.ParseIP(name); host == nil {
+	if host = net.ParseIP(name); host != nil {
+		return
+	}
+
+	if host = m.ids[name]; host != nil {
+		return
+	}
+
+	var status struct {
+		IPAddr string `json:"ip_addr"`
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(m.nodeDir, name)); err == nil && json.Unmarshal(data, &status) == nil {
+		host = net.ParseIP(status.IPAddr)
+	}
+
+	if host == nil {
 		m.log("unable to parse filename: ", path)
+		return
 	}
 
+	m.ids[name] = host
 	return
 }
 
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	nameq "github.com/ninchat/nameq/go"
 	"github.com/ninchat/nameq/service"
@@ -50,8 +51,10 @@ func Test(t *testing.T) {
 		service.Serve(ctx, &service.Params{
 			Addr:       localAddr,
 			Features:   "{ \"feature-1\": true, \"feature-2\": [1, 2, 3] }",
+			Labels:     map[string]string{nameq.LabelZone: "test-1a"},
 			FeatureDir: featureDir,
 			StateDir:   stateDir,
+			HostView:   true,
 			SendMode: &service.PacketMode{
 				Secret: []byte("swordfish"),
 			},
@@ -81,9 +84,49 @@ func Test(t *testing.T) {
 			continue
 		}
 
+		if f.Labels[nameq.LabelZone] != "test-1a" {
+			t.Errorf("labels: %v", f.Labels)
+		}
+
 		t.Logf("feature: name=%s host=%s value=%s", f.Name, f.Host, value)
 	}
 
+	if labels, err := nameq.LocalLabels(stateDir); err != nil || labels[nameq.LabelZone] != "test-1a" {
+		t.Error(labels, err)
+	}
+
+	hm, err := nameq.NewHostMonitor(stateDir, monitorLogger)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer hm.Close()
+
+	for i := 0; i < 2; i++ {
+		f := <-hm.C
+
+		if f.Host.String() != "127.0.0.1" || f.Data == nil {
+			t.Errorf("host view: name=%s host=%s data=%s", f.Name, f.Host, f.Data)
+		}
+	}
+
+	if features, err := nameq.HostFeatures(stateDir, "127.0.0.1"); err != nil || len(features) != 2 {
+		t.Error(features, err)
+	}
+
+	// The snapshot is written after the feature files.
+	var s *nameq.Snapshot
+	for i := 0; i < 100; i++ {
+		if s, err = nameq.ReadSnapshot(stateDir); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if err != nil || s.Generation == 0 || len(s.Hosts["127.0.0.1"].Features) != 2 {
+		t.Error(s, err)
+	}
+
 	cancel()
 	<-done
 }
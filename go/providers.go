@@ -0,0 +1,110 @@
+package nameq
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Labels with special meaning.  Providers prefers hosts in the same zone, and
+// then in the same region.
+const (
+	LabelRegion = "region"
+	LabelZone   = "zone"
+	LabelRack   = "rack"
+	LabelRole   = "role"
+)
+
+// LocalLabels reads the labels of the local host from the specified state
+// directory, or the default state directory if an empty string is given.
+func LocalLabels(stateDir string) (labels map[string]string, err error) {
+	if stateDir == "" {
+		stateDir = DefaultStateDir
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(stateDir, "labels", "127.0.0.1"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	err = json.Unmarshal(data, &labels)
+	return
+}
+
+// Providers keeps track of the hosts which provide a feature.  Pass the
+// Features of one name to Update, e.g. from a FeatureDemux subscription.  The
+// zero value is ready to use, and the methods may be called concurrently.
+type Providers struct {
+	lock  sync.Mutex
+	hosts map[string]*Feature
+}
+
+// Update adds, updates or removes (if Data is nil) a host.
+func (p *Providers) Update(f *Feature) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if f.Data == nil {
+		delete(p.hosts, f.Host.String())
+		return
+	}
+
+	if p.hosts == nil {
+		p.hosts = make(map[string]*Feature)
+	}
+	p.hosts[f.Host.String()] = f
+}
+
+// Hosts returns the current providers in order of preference: hosts in the
+// same zone as the local labels first, then hosts in the same region, and
+// then the rest.  The order is random within each group.
+func (p *Providers) Hosts(local map[string]string) (hosts []*Feature) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	groups := make([][]*Feature, 3)
+
+	for _, f := range p.hosts {
+		i := 2
+
+		switch {
+		case sameLabel(local, f.Labels, LabelZone):
+			i = 0
+
+		case sameLabel(local, f.Labels, LabelRegion):
+			i = 1
+		}
+
+		groups[i] = append(groups[i], f)
+	}
+
+	for _, group := range groups {
+		rand.Shuffle(len(group), func(i, j int) {
+			group[i], group[j] = group[j], group[i]
+		})
+
+		hosts = append(hosts, group...)
+	}
+	return
+}
+
+// Pick a random provider, preferring the zone and then the region of the
+// local labels.  nil is returned if there are no providers.
+func (p *Providers) Pick(local map[string]string) *Feature {
+	if hosts := p.Hosts(local); len(hosts) > 0 {
+		return hosts[0]
+	}
+
+	return nil
+}
+
+func sameLabel(a, b map[string]string, name string) bool {
+	value, found := a[name]
+	return found && value != "" && b[name] == value
+}
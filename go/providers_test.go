@@ -0,0 +1,41 @@
+package nameq_test
+
+import (
+	"net"
+	"testing"
+
+	nameq "github.com/ninchat/nameq/go"
+)
+
+func TestProviders(t *testing.T) {
+	var p nameq.Providers
+
+	if f := p.Pick(nil); f != nil {
+		t.Error(f)
+	}
+
+	for host, labels := range map[string]map[string]string{
+		"10.0.0.1": {"region": "eu", "zone": "eu-1a"},
+		"10.0.0.2": {"region": "eu", "zone": "eu-1b"},
+		"10.0.0.3": {"region": "us", "zone": "us-1a"},
+		"10.0.0.4": nil,
+	} {
+		p.Update(&nameq.Feature{Name: "test", Host: net.ParseIP(host), Data: []byte("true"), Labels: labels})
+	}
+
+	local := map[string]string{"region": "eu", "zone": "eu-1b"}
+
+	hosts := p.Hosts(local)
+	if len(hosts) != 4 || hosts[0].Host.String() != "10.0.0.2" || hosts[1].Host.String() != "10.0.0.1" {
+		t.Error(hosts)
+	}
+
+	p.Update(&nameq.Feature{Name: "test", Host: net.ParseIP("10.0.0.2")})
+	p.Update(&nameq.Feature{Name: "test", Host: net.ParseIP("10.0.0.1")})
+
+	for i := 0; i < 10; i++ {
+		if f := p.Pick(local); f == nil || f.Host.String() == "10.0.0.1" || f.Host.String() == "10.0.0.2" {
+			t.Error(f)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package nameq
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// Snapshot of the whole cluster.  Generation increases whenever the content
+// changes.  Hosts are named by IP address, or node id if the service names
+// hosts by id; the local host is 127.0.0.1.
+type Snapshot struct {
+	Generation int64                    `json:"generation"`
+	Hosts      map[string]*SnapshotHost `json:"hosts"`
+}
+
+// SnapshotHost describes a host.  Membership is "alive", "suspect", "failed"
+// or "left".  Features of hidden hosts are omitted.
+type SnapshotHost struct {
+	IPAddr     string                     `json:"ip_addr"`
+	Id         string                     `json:"id,omitempty"`
+	Labels     map[string]string          `json:"labels,omitempty"`
+	Membership string                     `json:"membership"`
+	Damped     bool                       `json:"damped,omitempty"`
+	Features   map[string]json.RawMessage `json:"features,omitempty"`
+}
+
+// ReadSnapshot reads the cluster snapshot from the specified state directory,
+// or the default state directory if an empty string is given.  The file is
+// replaced atomically, so the snapshot is consistent.
+func ReadSnapshot(stateDir string) (s *Snapshot, err error) {
+	if stateDir == "" {
+		stateDir = DefaultStateDir
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(stateDir, "snapshot.json"))
+	if err != nil {
+		return
+	}
+
+	s = new(Snapshot)
+	if err = json.Unmarshal(data, s); err != nil {
+		s = nil
+	}
+	return
+}
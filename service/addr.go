@@ -0,0 +1,111 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// peerAddr is a destination, and the transport and protocol version used
+// with it.  TLS addresses are represented as UDP addresses, too.
+type peerAddr struct {
+	*net.UDPAddr
+	transport transportKind
+	version   int
+	ipAddr    string // Primary address of the node, if known.
+}
+
+// splitZone separates the zone from an IPv6 address such as "fe80::1%eth0".
+func splitZone(s string) (ipAddr, zone string) {
+	if i := strings.LastIndexByte(s, '%'); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+
+	return s, ""
+}
+
+// parseIPAddr parses an IPv4 or IPv6 address, which may have a zone.
+func parseIPAddr(s string) (ip net.IP, zone string, err error) {
+	s, zone = splitZone(s)
+
+	if ip = net.ParseIP(s); ip == nil {
+		err = fmt.Errorf("bad IP address: %s", s)
+	}
+	return
+}
+
+// canonicalIPAddr converts an IP address to the form which is used to
+// identify nodes in packets, S3 keys and state file names.  The zone is
+// dropped, since it's meaningful only on the local host.
+func canonicalIPAddr(s string) (ipAddr string, err error) {
+	ip, _, err := parseIPAddr(s)
+	if err == nil {
+		ipAddr = ip.String()
+	}
+	return
+}
+
+func canonicalIPAddrs(addrs []string) (canonical []string, err error) {
+	for _, s := range addrs {
+		var ipAddr string
+
+		if ipAddr, err = canonicalIPAddr(s); err != nil {
+			return
+		}
+
+		canonical = append(canonical, ipAddr)
+	}
+	return
+}
+
+// validUnicast accepts addresses which may be the origin of a packet.  Private,
+// unique local, link-local and loopback addresses are all fine.
+func validUnicast(ip net.IP) bool {
+	return ip != nil && !ip.IsUnspecified() && !ip.IsMulticast() && !ip.Equal(net.IPv4bcast)
+}
+
+// checkPeerAddrs makes sure that the canonical addresses advertised by a remote
+// node may be used as send targets and names in the state directory, where
+// loopbackIPAddr names the local host.  Other loopback addresses are accepted
+// only if the local node is also on loopback, i.e. in a single-host cluster.
+func checkPeerAddrs(local *localNode, node *Node) (err error) {
+	localLoopback := net.ParseIP(local.ipAddr).IsLoopback()
+
+	for _, s := range node.ipAddrs() {
+		ip := net.ParseIP(s)
+
+		switch {
+		case !validUnicast(ip) || s == loopbackIPAddr || (ip.IsLoopback() && !localLoopback):
+			err = fmt.Errorf("bad peer address: %s", s)
+			return
+
+		case local.hasAddr(s):
+			err = fmt.Errorf("peer claims local address %s", s)
+			return
+		}
+	}
+	return
+}
+
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+// parseNets parses CIDR notation.
+func parseNets(specs []string) (nets []*net.IPNet, err error) {
+	for _, spec := range specs {
+		var n *net.IPNet
+
+		if _, n, err = net.ParseCIDR(spec); err != nil {
+			return
+		}
+
+		nets = append(nets, n)
+	}
+	return
+}
+
+func resolveAddr(ipAddr string, port int) (addr *net.UDPAddr, err error) {
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(ipAddr, strconv.Itoa(port)))
+}
@@ -0,0 +1,366 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+var (
+	testMode = &PacketMode{
+		Secret: []byte("swordfish"),
+	}
+
+	testLog = Log{
+		ErrorLogger: log.New(os.Stderr, "service error: ", 0),
+	}
+)
+
+func TestCanonicalIPAddr(t *testing.T) {
+	for s, expect := range map[string]string{
+		"10.0.0.1":           "10.0.0.1",
+		"2001:DB8:0:0::1":    "2001:db8::1",
+		"fe80::1%eth0":       "fe80::1",
+		"::ffff:192.168.1.1": "192.168.1.1",
+	} {
+		if ipAddr, err := canonicalIPAddr(s); err != nil {
+			t.Errorf("%s: %s", s, err)
+		} else if ipAddr != expect {
+			t.Errorf("%s: %s", s, ipAddr)
+		}
+	}
+
+	if _, err := canonicalIPAddr("example.com"); err == nil {
+		t.Error("hostname accepted")
+	}
+}
+
+func TestResolveAddr(t *testing.T) {
+	for s, expect := range map[string]string{
+		"10.0.0.1":    "10.0.0.1:17106",
+		"2001:db8::1": "[2001:db8::1]:17106",
+		"fe80::1%lo":  "[fe80::1%lo]:17106",
+	} {
+		if addr, err := resolveAddr(s, DefaultPort); err != nil {
+			t.Errorf("%s: %s", s, err)
+		} else if addr.String() != expect {
+			t.Errorf("%s: %s", s, addr)
+		}
+	}
+}
+
+func TestValidUnicast(t *testing.T) {
+	for s, expect := range map[string]bool{
+		"10.0.0.1":        true,
+		"127.0.0.1":       true,
+		"::1":             true,
+		"fd00::1":         true,
+		"fe80::1":         true,
+		"0.0.0.0":         false,
+		"::":              false,
+		"ff02::1":         false,
+		"224.0.0.1":       false,
+		"255.255.255.255": false,
+	} {
+		if validUnicast(net.ParseIP(s)) != expect {
+			t.Errorf("%s", s)
+		}
+	}
+}
+
+func TestVerifyPacketOrigin(t *testing.T) {
+	node := &Node{
+		IPAddr: "10.0.0.1",
+		Addrs:  []string{"2001:DB8::1"},
+	}
+
+	if err := verifyPacketOrigin(node, &net.UDPAddr{IP: net.ParseIP("2001:db8::1")}); err != nil {
+		t.Error(err)
+	}
+
+	if node.Addrs[0] != "2001:db8::1" {
+		t.Error(node.Addrs)
+	}
+
+	if err := verifyPacketOrigin(node, &net.UDPAddr{IP: net.ParseIP("2001:db8::2")}); !errors.Is(err, errPacketOrigin) {
+		t.Error("bad origin accepted:", err)
+	}
+
+	node.Addrs = append(node.Addrs, "bogus")
+
+	if err := verifyPacketOrigin(node, &net.UDPAddr{IP: net.ParseIP("10.0.0.1")}); !errors.Is(err, errPacketMalformed) {
+		t.Error("bad address accepted:", err)
+	}
+}
+
+func TestSelectAddr(t *testing.T) {
+	local := newTestLocalNode(t, "::1")
+	defer closeTestLocalNode(local)
+
+	addr := local.selectAddr(&Node{
+		IPAddr: "10.0.0.1",
+		Addrs:  []string{"fd00::1"},
+	}, DefaultPort, nil)
+
+	if addr.String() != "[fd00::1]:17106" {
+		t.Error(addr)
+	}
+}
+
+func TestIPv6LoopbackCluster(t *testing.T) {
+	a := newTestLocalNode(t, "::1")
+	defer closeTestLocalNode(a)
+
+	b := newTestBoundNode(t, "127.0.0.2", "::1")
+	defer closeTestLocalNode(b)
+
+	node := receiveTestPacket(t, a, b)
+
+	if node.IPAddr != "::1" {
+		t.Error(node.IPAddr)
+	}
+}
+
+func TestDualStackCluster(t *testing.T) {
+	a := newTestLocalNode(t, "127.0.0.2", "::1")
+	defer closeTestLocalNode(a)
+
+	b := newTestBoundNode(t, "127.0.0.3", "::1")
+	defer closeTestLocalNode(b)
+
+	node := receiveTestPacket(t, a, b)
+
+	if node.IPAddr != "127.0.0.2" || len(node.Addrs) != 1 || node.Addrs[0] != "::1" {
+		t.Error(node.IPAddr, node.Addrs)
+	}
+}
+
+// newTestLocalNode binds to an ephemeral port, and advertises it.
+func newTestLocalNode(t *testing.T, ipAddr string, altAddrs ...string) *localNode {
+	local, err := newLocalNode(&Params{
+		Addr:     ipAddr,
+		AltAddrs: altAddrs,
+		SendMode: testMode,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local.port = local.udp.conns[0].LocalAddr().(*net.UDPAddr).Port
+
+	return local
+}
+
+// newTestBoundNode binds to a loopback address other than the advertised one.
+// There is only one IPv6 loopback address, but nodes need distinct identities.
+func newTestBoundNode(t *testing.T, ipAddr, bindAddr string) *localNode {
+	local, err := newLocalNode(&Params{
+		Addr:     ipAddr,
+		BindAddr: bindAddr,
+		SendMode: testMode,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local.port = local.udp.conns[0].LocalAddr().(*net.UDPAddr).Port
+
+	return local
+}
+
+// testPeerAddr returns the last bound address of the node.
+func testPeerAddr(local *localNode) *peerAddr {
+	return &peerAddr{
+		UDPAddr: local.udp.conns[len(local.udp.conns)-1].LocalAddr().(*net.UDPAddr),
+		ipAddr:  local.ipAddr,
+		version: maxProtocolVersion,
+	}
+}
+
+func closeTestLocalNode(local *localNode) {
+	local.close()
+}
+
+// listenTestPackets starts receiving packets on all transports of the node.
+func listenTestPackets(local *localNode, remotes *remoteNodes, policy OriginPolicy, gossip bool, notify chan<- struct{}, reply chan<- []*peerAddr) {
+	r := &receiver{
+		local:   local,
+		remotes: remotes,
+		modes: map[int]*PacketMode{
+			testMode.Id: testMode,
+		},
+		policy: policy,
+		gossip: gossip,
+		stats:  new(Stats),
+		notify: notify,
+		reply:  reply,
+		log:    &testLog,
+	}
+	r.listen()
+}
+
+// receiveTestPacket sends the state of node a to node b, and returns what b
+// has learned.
+func receiveTestPacket(t *testing.T, a, b *localNode) *Node {
+	value := json.RawMessage("true")
+	a.updateFeatures(map[string]*json.RawMessage{"test": &value})
+
+	remotes := newRemoteNodes(0)
+	notify := make(chan struct{}, 1)
+	reply := make(chan []*peerAddr, 1)
+
+	listenTestPackets(b, remotes, OriginAddress, false, notify, reply)
+
+	transmit(a, []*peerAddr{testPeerAddr(b)}, nil, 0, false, &testLog)
+
+	select {
+	case <-notify:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	addrs := <-reply
+	if !addrs[0].IP.Equal(a.udp.conns[len(a.udp.conns)-1].LocalAddr().(*net.UDPAddr).IP) || addrs[0].Port != a.port {
+		t.Error(addrs[0])
+	}
+
+	nodes := remotes.nodes()
+	if len(nodes) != 1 {
+		t.Fatal(nodes)
+	}
+
+	if nodes[0].Features["test"] == nil {
+		t.Error(nodes[0].Features)
+	}
+
+	return nodes[0]
+}
+
+func TestBadPeerAddrs(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := newTestLocalNode(t, "127.0.0.2", "::1")
+	defer closeTestLocalNode(local)
+
+	r := &receiver{
+		local:   local,
+		remotes: newRemoteNodes(0),
+		modes: map[int]*PacketMode{
+			testMode.Id: testMode,
+		},
+		policy:  OriginAny,
+		stats:   new(Stats),
+		notify:  make(chan struct{}, 1),
+		reply:   make(chan []*peerAddr, 100),
+		log:     &testLog,
+		limiter: newRateLimiter(sourcePacketRate, sourcePacketBurst),
+	}
+
+	sender := &Node{IPAddr: "10.0.0.100"}
+
+	for i, c := range []struct {
+		ipAddr string
+		addrs  []string
+		valid  bool
+	}{
+		{"0.0.0.0", nil, false},
+		{"255.255.255.255", nil, false},
+		{"239.255.0.1", nil, false},
+		{"127.0.0.1", nil, false},
+		{"127.0.0.2", nil, false},
+		{"10.0.0.1", []string{"::"}, false},
+		{"10.0.0.1", []string{"ff02::1"}, false},
+		{"10.0.0.1", []string{"::1"}, false},
+		{"10.0.0.1", []string{"2001:db8::1"}, true},
+	} {
+		node := &Node{IPAddr: c.ipAddr, Addrs: c.addrs, Seq: 1, ProtoMax: maxProtocolVersion}
+
+		if err := checkPeerAddrs(local, node); (err == nil) != c.valid {
+			t.Errorf("%s %v: %v", c.ipAddr, c.addrs, err)
+		}
+
+		// Received directly.
+		data, err := encodePacket(node, testMode, maxProtocolVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		origin := &peerAddr{UDPAddr: &net.UDPAddr{IP: net.IPv4(10, 0, 1, byte(i+1)), Port: DefaultPort}}
+		r.receive(data, origin)
+
+		if status := r.remotes.statuses()[c.ipAddr]; (status != nil) != c.valid {
+			t.Errorf("%s %v received: %#v", c.ipAddr, c.addrs, status)
+		}
+
+		// Relayed, when the key is known via S3.
+		remotes := newRemoteNodes(0)
+		stored := &Node{IPAddr: c.ipAddr, Seq: 1, ProtoMax: maxProtocolVersion}
+		signNode(stored, key)
+		remotes.update(stored, sourceStorage, nil, time.Now(), local, &testLog)
+
+		relayed := &Node{IPAddr: c.ipAddr, Addrs: c.addrs, Seq: 2, ProtoMax: maxProtocolVersion}
+		signNode(relayed, key)
+
+		receiveRelayed(local, remotes, sender, []*Node{relayed}, &testLog)
+
+		if status := remotes.statuses()[c.ipAddr]; (status.Source == sourceRelay.String()) != c.valid {
+			t.Errorf("%s %v relayed: %#v", c.ipAddr, c.addrs, status)
+		}
+	}
+}
+
+func TestLoopbackPeerAddrs(t *testing.T) {
+	local := newTestBoundNode(t, "10.0.0.2", "127.0.0.2")
+	defer closeTestLocalNode(local)
+
+	r := &receiver{
+		local:   local,
+		remotes: newRemoteNodes(0),
+		modes: map[int]*PacketMode{
+			testMode.Id: testMode,
+		},
+		policy:  OriginAny,
+		stats:   new(Stats),
+		notify:  make(chan struct{}, 1),
+		reply:   make(chan []*peerAddr, 100),
+		log:     &testLog,
+		limiter: newRateLimiter(sourcePacketRate, sourcePacketBurst),
+	}
+
+	for i, c := range []struct {
+		ipAddr string
+		addrs  []string
+		valid  bool
+	}{
+		{"127.0.0.3", nil, false},
+		{"10.0.0.1", []string{"::1"}, false},
+		{"192.168.0.1", []string{"fe80::1"}, true},
+	} {
+		node := &Node{IPAddr: c.ipAddr, Addrs: c.addrs, Seq: 1, ProtoMax: maxProtocolVersion}
+
+		if err := checkPeerAddrs(local, node); (err == nil) != c.valid {
+			t.Errorf("%s %v: %v", c.ipAddr, c.addrs, err)
+		}
+
+		data, err := encodePacket(node, testMode, maxProtocolVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		origin := &peerAddr{UDPAddr: &net.UDPAddr{IP: net.IPv4(10, 0, 1, byte(i+1)), Port: DefaultPort}}
+		r.receive(data, origin)
+
+		if status := r.remotes.statuses()[c.ipAddr]; (status != nil) != c.valid {
+			t.Errorf("%s %v received: %#v", c.ipAddr, c.addrs, status)
+		}
+	}
+}
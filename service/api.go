@@ -0,0 +1,250 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// apiRequest is a line sent by a client of the control socket.  Op is one of
+// "nodes", "features", "set", "remove", "resync" or "subscribe".  Name and
+// Value are used with "set" and "remove".
+type apiRequest struct {
+	Op    string           `json:"op"`
+	Name  string           `json:"name,omitempty"`
+	Value *json.RawMessage `json:"value,omitempty"`
+}
+
+// apiResponse is written for each request.  A successful "subscribe" is
+// followed by Event lines until the connection is closed.
+type apiResponse struct {
+	OK     bool        `json:"ok"`
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+var errAPIPermission = errors.New("permission denied")
+
+// api serves the control socket and the HTTP API.  Any client which is able
+// to connect may query the state and subscribe to events, but changes require
+// the client to run as root, as the same user as the service, or as one of the
+// allowed users.
+type api struct {
+	local         *localNode
+	remotes       *remoteNodes
+	hub           *eventHub
+	featureDir    string
+	stats         *Stats
+	uids          map[int]bool
+	resyncStorage chan<- struct{}
+	wakeTransmit  chan<- struct{}
+	log           *Log
+}
+
+func initAPI(ctx context.Context, a *api, path string, mode os.FileMode) (err error) {
+	if info, statErr := os.Lstat(path); statErr == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path) // Left behind by a crash.
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return
+	}
+
+	if err = os.Chmod(path, mode); err != nil {
+		l.Close()
+		return
+	}
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	go apiLoop(a, l)
+
+	return
+}
+
+func apiLoop(a *api, l *net.UnixListener) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				a.log.Error(err)
+			}
+			return
+		}
+
+		go a.serve(conn)
+	}
+}
+
+func (a *api) serve(conn *net.UnixConn) {
+	defer conn.Close()
+
+	privileged := a.privileged(conn)
+
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+
+	for scanner.Scan() {
+		req := new(apiRequest)
+		if err := json.Unmarshal(scanner.Bytes(), req); err != nil {
+			encoder.Encode(&apiResponse{Error: err.Error()})
+			continue
+		}
+
+		if req.Op == "subscribe" {
+			a.subscribe(conn, encoder)
+			return
+		}
+
+		result, err := a.handle(req, privileged)
+		if err != nil {
+			a.log.Debugf("API %s: %s", req.Op, err)
+
+			if encoder.Encode(&apiResponse{Error: err.Error()}) != nil {
+				return
+			}
+			continue
+		}
+
+		if encoder.Encode(&apiResponse{OK: true, Result: result}) != nil {
+			return
+		}
+	}
+}
+
+func (a *api) privileged(conn *net.UnixConn) bool {
+	uid, err := peerUid(conn)
+	if err != nil {
+		a.log.Debugf("API peer credentials: %s", err)
+		return false
+	}
+
+	return uid == 0 || uid == os.Getuid() || a.uids[uid]
+}
+
+func (a *api) handle(req *apiRequest, privileged bool) (result interface{}, err error) {
+	switch req.Op {
+	case "nodes":
+		result = a.remotes.statuses()
+
+	case "features":
+		result = a.features()
+
+	case "set", "remove":
+		if !privileged {
+			err = errAPIPermission
+			return
+		}
+
+		if !featureRE.MatchString(req.Name) {
+			err = fmt.Errorf("bad feature name: %q", req.Name)
+			return
+		}
+
+		if a.featureDir == "" {
+			err = errors.New("no feature directory")
+			return
+		}
+
+		if req.Op == "set" {
+			if req.Value == nil {
+				err = errors.New("no feature value")
+				return
+			}
+
+			err = writeFeatureConfig(a.featureDir, req.Name, *req.Value)
+		} else {
+			if err = os.Remove(filepath.Join(a.featureDir, req.Name)); os.IsNotExist(err) {
+				err = nil
+			}
+		}
+
+	case "resync":
+		if !privileged {
+			err = errAPIPermission
+			return
+		}
+
+		for _, c := range []chan<- struct{}{a.resyncStorage, a.wakeTransmit} {
+			select {
+			case c <- struct{}{}:
+			default:
+			}
+		}
+
+	default:
+		err = fmt.Errorf("unknown operation: %q", req.Op)
+	}
+
+	return
+}
+
+// features of all visible hosts (including the local host) by feature name
+// and IP address.
+func (a *api) features() map[string]map[string]*json.RawMessage {
+	features := make(map[string]map[string]*json.RawMessage)
+
+	add := func(ipAddr string, node *Node) {
+		for name, value := range node.Features {
+			hosts := features[name]
+			if hosts == nil {
+				hosts = make(map[string]*json.RawMessage)
+				features[name] = hosts
+			}
+			hosts[ipAddr] = value
+		}
+	}
+
+	add(a.local.ipAddr, a.local.getNode())
+
+	for _, node := range a.remotes.nodes() {
+		add(node.IPAddr, node)
+	}
+
+	return features
+}
+
+// subscribe writes the current state and then changes as events, until the
+// client closes the connection or falls behind.
+func (a *api) subscribe(conn *net.UnixConn, encoder *json.Encoder) {
+	events := a.hub.subscribe()
+	defer a.hub.unsubscribe(events)
+
+	if encoder.Encode(&apiResponse{OK: true}) != nil {
+		return
+	}
+
+	closed := make(chan struct{})
+
+	go func() {
+		defer close(closed)
+		ioutil.ReadAll(conn)
+	}()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				a.log.Info("API subscriber fell behind")
+				return
+			}
+
+			if encoder.Encode(e) != nil {
+				return
+			}
+
+		case <-closed:
+			return
+		}
+	}
+}
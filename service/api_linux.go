@@ -0,0 +1,30 @@
+package service
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerUid returns the user id of the process at the other end of the socket.
+func peerUid(conn *net.UnixConn) (uid int, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+
+	if err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return
+	}
+
+	if err = credErr; err != nil {
+		return
+	}
+
+	uid = int(cred.Uid)
+	return
+}
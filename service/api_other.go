@@ -0,0 +1,15 @@
+//go:build !linux
+
+package service
+
+import (
+	"errors"
+	"net"
+)
+
+// peerUid is not supported on this platform, so only unprivileged requests
+// are allowed.
+func peerUid(conn *net.UnixConn) (uid int, err error) {
+	err = errors.New("peer credentials are not supported on this platform")
+	return
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nameq-service-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := newTestLocalNode(t, "127.0.0.1")
+	defer closeTestLocalNode(local)
+
+	value := json.RawMessage("true")
+	remotes := newRemoteNodes(0)
+	remotes.update(&Node{IPAddr: "10.0.0.1", Seq: 1, Features: map[string]*json.RawMessage{"test": &value}}, sourcePacket, nil, time.Now(), local, &testLog)
+
+	hub := newEventHub()
+	hub.update(snapshotHosts(local, remotes.view(), LayoutIP))
+
+	resync := make(chan struct{}, 1)
+
+	a := &api{
+		local:         local,
+		remotes:       remotes,
+		hub:           hub,
+		featureDir:    dir,
+		resyncStorage: resync,
+		log:           &testLog,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(dir, ".socket")
+
+	if err := initAPI(ctx, a, path, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Error(info, err)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	lines := bufio.NewScanner(conn)
+
+	call := func(req string, result interface{}) (res *apiResponse) {
+		if _, err := conn.Write([]byte(req + "\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		if !lines.Scan() {
+			t.Fatal(lines.Err())
+		}
+
+		res = &apiResponse{Result: result}
+		if err := json.Unmarshal(lines.Bytes(), res); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	var statuses map[string]*NodeStatus
+	if res := call(`{"op":"nodes"}`, &statuses); !res.OK || statuses["10.0.0.1"] == nil {
+		t.Errorf("nodes: %#v", res)
+	}
+
+	var features map[string]map[string]bool
+	if res := call(`{"op":"features"}`, &features); !res.OK || !features["test"]["10.0.0.1"] {
+		t.Errorf("features: %#v", res)
+	}
+
+	if res := call(`{"op":"set","name":"foo","value":{"port":80}}`, nil); !res.OK {
+		t.Errorf("set: %#v", res)
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "foo")); err != nil || string(data) != `{"port":80}` {
+		t.Errorf("set: %q %v", data, err)
+	}
+
+	if res := call(`{"op":"set","name":"../foo","value":1}`, nil); res.OK {
+		t.Error("bad name accepted")
+	}
+
+	if res := call(`{"op":"remove","name":"foo"}`, nil); !res.OK {
+		t.Errorf("remove: %#v", res)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "foo")); !os.IsNotExist(err) {
+		t.Errorf("remove: %v", err)
+	}
+
+	if res := call(`{"op":"resync"}`, nil); !res.OK || len(resync) != 1 {
+		t.Errorf("resync: %#v", res)
+	}
+
+	if res := call(`{"op":"bogus"}`, nil); res.OK || res.Error == "" {
+		t.Errorf("bogus: %#v", res)
+	}
+
+	if res := call(`{"op":"subscribe"}`, nil); !res.OK {
+		t.Fatalf("subscribe: %#v", res)
+	}
+
+	next := func() *Event {
+		if !lines.Scan() {
+			t.Fatal(lines.Err())
+		}
+
+		e := new(Event)
+		if err := json.Unmarshal(lines.Bytes(), e); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	// Current state.
+	if e := next(); e.Type != EventMembership || e.Host != "10.0.0.1" || *e.Membership != MemberAlive {
+		t.Errorf("%#v", e)
+	}
+	if e := next(); e.Type != EventFeature || e.Host != "10.0.0.1" || e.Feature != "test" || string(*e.Value) != "true" {
+		t.Errorf("%#v", e)
+	}
+	if e := next(); e.Type != EventMembership || e.Host != "127.0.0.1" {
+		t.Errorf("%#v", e)
+	}
+
+	remotes.update(&Node{IPAddr: "10.0.0.1", Seq: 2, Leaving: true}, sourcePacket, nil, time.Now(), local, &testLog)
+	hub.update(snapshotHosts(local, remotes.view(), LayoutIP))
+
+	if e := next(); e.Type != EventMembership || *e.Membership != MemberLeft {
+		t.Errorf("%#v", e)
+	}
+	if e := next(); e.Type != EventFeature || e.Feature != "test" || e.Value != nil {
+		t.Errorf("%#v", e)
+	}
+}
+
+func TestDiffHosts(t *testing.T) {
+	a := json.RawMessage("1")
+	b := json.RawMessage("2")
+
+	old := map[string]*SnapshotHost{
+		"x": {IPAddr: "10.0.0.1", Features: map[string]*json.RawMessage{"f": &a, "g": &a}},
+		"y": {IPAddr: "10.0.0.2", Features: map[string]*json.RawMessage{"f": &a}},
+	}
+
+	new := map[string]*SnapshotHost{
+		"x": {IPAddr: "10.0.0.1", Features: map[string]*json.RawMessage{"f": &a, "g": &b}},
+	}
+
+	events := diffHosts(old, new)
+
+	if len(events) != 3 {
+		t.Fatalf("%d events", len(events))
+	}
+
+	if e := events[0]; e.Host != "x" || e.Feature != "g" || string(*e.Value) != "2" {
+		t.Errorf("%#v", e)
+	}
+
+	if e := events[1]; e.Host != "y" || e.Feature != "f" || e.Value != nil {
+		t.Errorf("%#v", e)
+	}
+
+	if e := events[2]; e.Host != "y" || e.Type != EventRemoved || e.IPAddr != "10.0.0.2" {
+		t.Errorf("%#v", e)
+	}
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	clockSkewTolerance = time.Second * 15
+
+	clockOffsetSmoothing = 8
+)
+
+// hybridClock produces sequence numbers which follow the wall clock, but never
+// go backwards.  They are used to order the states sent by a single node, so
+// the wall clocks of different nodes are never compared with each other.
+type hybridClock struct {
+	lock sync.Mutex
+	last int64
+}
+
+func (c *hybridClock) now() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	t := time.Now().UnixNano()
+	if t <= c.last {
+		t = c.last + 1
+	}
+	c.last = t
+	return t
+}
+
+// observe a sequence number produced by an earlier incarnation of this node.
+func (c *hybridClock) observe(seq int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if seq > c.last {
+		c.last = seq
+	}
+}
+
+// latest returns the last sequence number.
+func (c *hybridClock) latest() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.last
+}
+
+// reserve returns a sequence number which won't be reached during the period,
+// unless the wall clock jumps forward.
+func (c *hybridClock) reserve(period time.Duration) int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	t := time.Now().UnixNano()
+	if t < c.last {
+		t = c.last
+	}
+	return t + int64(period)
+}
+
+// smoothClockOffset updates an estimate of a peer's clock offset with a new
+// sample.
+func smoothClockOffset(offset, sample time.Duration, first bool) time.Duration {
+	if first {
+		return sample
+	}
+
+	return offset + (sample-offset)/clockOffsetSmoothing
+}
+
+func clockSkewed(offset time.Duration) bool {
+	return offset > clockSkewTolerance || offset < -clockSkewTolerance
+}
@@ -3,21 +3,67 @@ package service
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
 var (
 	featureRE = regexp.MustCompile("^[a-zA-Z0-9-_]+$")
+	labelRE   = regexp.MustCompile("^[a-zA-Z0-9-_.]+$")
 )
 
-func watchConfig(dir string, re *regexp.Regexp, log *Log, handler func(filenames []string)) (err error) {
+// ParseLabels converts a comma-separated list of NAME=VALUE pairs to a map.
+func ParseLabels(s string) (labels map[string]string, err error) {
+	labels = make(map[string]string)
+
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+
+		i := strings.IndexByte(pair, '=')
+		if i < 0 {
+			err = fmt.Errorf("label without value: %s", pair)
+			return
+		}
+
+		labels[pair[:i]] = pair[i+1:]
+	}
+
+	err = checkLabels(labels)
+	return
+}
+
+func checkLabels(labels map[string]string) error {
+	if len(labels) > maxNodeLabels {
+		return fmt.Errorf("too many labels: %d", len(labels))
+	}
+
+	for name, value := range labels {
+		if !labelRE.MatchString(name) {
+			return fmt.Errorf("bad label name: %q", name)
+		}
+
+		if len(name)+len(value) > maxLabelSize {
+			return fmt.Errorf("label is too long: %s", name)
+		}
+	}
+
+	return nil
+}
+
+// watchConfig scans the directory now and whenever it changes.  Changes which
+// occur within the window after a scan are coalesced into one scan at the end
+// of the window.
+func watchConfig(dir string, re *regexp.Regexp, window time.Duration, log *Log, handler func(filenames []string)) (err error) {
 	if dir == "" {
 		return
 	}
@@ -34,19 +80,41 @@ func watchConfig(dir string, re *regexp.Regexp, log *Log, handler func(filenames
 
 	scanConfig(dir, re, handler, log)
 
-	go scanConfigLoop(dir, re, handler, w, log)
+	go scanConfigLoop(dir, re, window, handler, w, log)
 
 	return
 }
 
-func scanConfigLoop(dir string, re *regexp.Regexp, handler func(filenames []string), w *fsnotify.Watcher, log *Log) {
+func scanConfigLoop(dir string, re *regexp.Regexp, window time.Duration, handler func(filenames []string), w *fsnotify.Watcher, log *Log) {
+	var (
+		wait    <-chan time.Time
+		pending bool
+	)
+
 	for {
 		select {
 		case <-w.Events:
-			scanConfig(dir, re, handler, log)
+			if wait != nil {
+				pending = true
+				continue
+			}
+
+		case <-wait:
+			wait = nil
+			if !pending {
+				continue
+			}
+			pending = false
 
 		case err := <-w.Errors:
 			log.Error(err)
+			continue
+		}
+
+		scanConfig(dir, re, handler, log)
+
+		if window > 0 {
+			wait = time.After(window)
 		}
 	}
 }
@@ -69,7 +137,33 @@ func scanConfig(dir string, re *regexp.Regexp, handler func(filenames []string),
 	handler(filenames)
 }
 
-func initFeatureConfig(local *localNode, arg, dir string, notify chan<- struct{}, log *Log) (err error) {
+// writeFeatureConfig replaces a feature file atomically.  The temporary file
+// is ignored by the config watcher.
+func writeFeatureConfig(dir, name string, data []byte) (err error) {
+	file, err := ioutil.TempFile(dir, "."+name+".")
+	if err != nil {
+		return
+	}
+
+	if _, err = file.Write(data); err == nil {
+		err = file.Chmod(0644)
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(dir, name))
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return
+}
+
+func initFeatureConfig(local *localNode, arg, dir string, window time.Duration, notify chan<- struct{}, log *Log) (err error) {
 	var argFeatures map[string]*json.RawMessage
 
 	if arg != "" {
@@ -80,7 +174,7 @@ func initFeatureConfig(local *localNode, arg, dir string, notify chan<- struct{}
 		argFeatures = make(map[string]*json.RawMessage)
 	}
 
-	return watchConfig(dir, featureRE, log, func(filenames []string) {
+	return watchConfig(dir, featureRE, window, log, func(filenames []string) {
 		features := make(map[string]*json.RawMessage)
 
 		for name, value := range argFeatures {
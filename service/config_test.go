@@ -0,0 +1,82 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels("region=eu,zone=eu-1a,rack=")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(labels) != 3 || labels["region"] != "eu" || labels["zone"] != "eu-1a" || labels["rack"] != "" {
+		t.Error(labels)
+	}
+
+	for _, s := range []string{"zone", "zone/x=a"} {
+		if _, err := ParseLabels(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
+
+func TestConfigCoalescing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nameq-service-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const window = time.Millisecond * 300
+
+	var (
+		lock  sync.Mutex
+		scans []int
+	)
+
+	err = watchConfig(dir, featureRE, window, &testLog, func(filenames []string) {
+		lock.Lock()
+		defer lock.Unlock()
+		scans = append(scans, len(filenames))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("true"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result := func() []int {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]int(nil), scans...)
+	}
+
+	for i := 0; i < 10; i++ {
+		write(fmt.Sprintf("burst-%d", i))
+	}
+
+	time.Sleep(window * 2)
+
+	// Initial scan, the first change, and the rest of the burst.
+	if s := result(); len(s) != 3 || s[0] != 0 || s[2] != 10 {
+		t.Error(s)
+	}
+
+	write("single")
+	time.Sleep(window / 3)
+
+	if s := result(); len(s) != 4 || s[3] != 11 {
+		t.Error("single change was delayed:", s)
+	}
+}
@@ -0,0 +1,160 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// confirmProtocolVersion is the lowest protocol version which supports
+	// change confirmations.  Other nodes learn about changes eventually via
+	// periodic transmissions.
+	confirmProtocolVersion = 4
+
+	// confirmTimeout is the initial retransmission timeout.  It doubles after
+	// each attempt.
+	confirmTimeout = time.Millisecond * 250
+
+	// confirmMaxAttempts bounds the retransmissions of a change.  The total
+	// time is about confirmTimeout << confirmMaxAttempts.
+	confirmMaxAttempts = 6
+)
+
+// confirmer retransmits a changed local state to the nodes which haven't
+// confirmed that they received it.  A change packet carries a probe with the
+// Change flag, and the receiver responds with a probe which confirms the
+// sequence number of the state.
+type confirmer struct {
+	local   *localNode
+	remotes *remoteNodes
+	log     *Log
+	wake    chan struct{}
+
+	lock     sync.Mutex
+	since    int64                // Sequence number preceding the change.
+	pending  map[string]*peerAddr // By primary address.
+	attempts int
+}
+
+func newConfirmer(local *localNode, remotes *remoteNodes, log *Log) *confirmer {
+	return &confirmer{
+		local:   local,
+		remotes: remotes,
+		log:     log,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// track a change which is about to be transmitted to addrs.  since must
+// precede the sequence number of the transmitted state.  It supersedes the
+// previous change.  The nodes are identified by their primary addresses, which
+// may differ from the transmission addresses.
+func (c *confirmer) track(since int64, addrs []*peerAddr) {
+	pending := make(map[string]*peerAddr)
+
+	for _, addr := range addrs {
+		if addr.version >= confirmProtocolVersion && addr.ipAddr != "" {
+			pending[addr.ipAddr] = addr
+		}
+	}
+
+	c.lock.Lock()
+	c.since = since
+	c.pending = pending
+	c.attempts = 0
+	c.lock.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// handle the probe of a packet sent by node.
+func (c *confirmer) handle(node *Node, probe *Probe) {
+	if probe.Confirm != 0 {
+		c.lock.Lock()
+		if probe.Confirm > c.since {
+			delete(c.pending, node.IPAddr)
+		}
+		c.lock.Unlock()
+	}
+
+	if probe.Change {
+		addr := c.remotes.probeAddr(node.IPAddr)
+		if addr == nil || addr.version < confirmProtocolVersion {
+			c.log.Debugf("change from unknown or unconfirmable node %s", node.IPAddr)
+			return
+		}
+
+		c.send(addr, &Probe{Confirm: node.Seq})
+	}
+}
+
+func confirmLoop(ctx context.Context, c *confirmer) {
+	timer := time.NewTimer(confirmTimeout)
+	timer.Stop()
+
+	for {
+		select {
+		case <-c.wake:
+			resetTimer(timer, confirmTimeout)
+			continue
+
+		case <-timer.C:
+
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		addrs, attempt := c.retransmittable()
+		if len(addrs) == 0 {
+			continue
+		}
+
+		if attempt > confirmMaxAttempts {
+			c.log.Infof("%d nodes didn't confirm change", len(addrs))
+			continue
+		}
+
+		c.log.Debugf("retransmitting change to %d nodes (attempt %d)", len(addrs), attempt)
+
+		for _, addr := range addrs {
+			c.send(addr, &Probe{Change: true})
+		}
+
+		timer.Reset(confirmTimeout << uint(attempt))
+	}
+}
+
+// retransmittable returns the nodes which haven't confirmed the change.
+// They are forgotten after the final attempt.
+func (c *confirmer) retransmittable() (addrs []*peerAddr, attempt int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.attempts++
+	attempt = c.attempts
+
+	for _, addr := range c.pending {
+		addrs = append(addrs, addr)
+	}
+
+	if attempt > confirmMaxAttempts {
+		c.pending = nil
+	}
+	return
+}
+
+func (c *confirmer) send(addr *peerAddr, probe *Probe) {
+	data, err := marshalPacket(c.local, nil, probe, addr.version)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := c.local.send(data, addr); err != nil {
+		c.log.Error(err)
+	}
+}
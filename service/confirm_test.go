@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConfirm(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := newTestMember(t, "127.0.0.3")
+	defer closeTestLocalNode(a.local)
+
+	b := newTestMember(t, "127.0.0.2")
+	defer closeTestLocalNode(b.local)
+
+	addrs := []*peerAddr{testPeerAddr(b.local)}
+
+	confirmed := func() bool {
+		for i := 0; i < 100; i++ {
+			a.confirmer.lock.Lock()
+			n := len(a.confirmer.pending)
+			a.confirmer.lock.Unlock()
+
+			if n == 0 {
+				return true
+			}
+
+			time.Sleep(time.Millisecond * 10)
+		}
+		return false
+	}
+
+	a.confirmer.track(a.local.clock.now(), addrs)
+	transmit(a.local, addrs, nil, 0, true, &testLog)
+
+	if !confirmed() {
+		t.Error("change was not confirmed")
+	}
+
+	// The change packet was lost.
+	go confirmLoop(ctx, a.confirmer)
+	a.confirmer.track(a.local.clock.now(), addrs)
+
+	if !confirmed() {
+		t.Error("change was not retransmitted")
+	}
+}
+
+func TestConfirmAltAddr(t *testing.T) {
+	local := newTestLocalNode(t, "127.0.0.1")
+	defer closeTestLocalNode(local)
+
+	c := newConfirmer(local, newRemoteNodes(0), &testLog)
+
+	// The change is transmitted to the alternative address of a dual-stack
+	// node.
+	c.track(10, []*peerAddr{{
+		UDPAddr: &net.UDPAddr{IP: net.ParseIP("2001:db8::2")},
+		version: maxProtocolVersion,
+		ipAddr:  "10.0.0.2",
+	}})
+
+	c.handle(&Node{IPAddr: "10.0.0.2", Addrs: []string{"2001:db8::2"}}, &Probe{Confirm: 11})
+
+	if len(c.pending) != 0 {
+		t.Error("confirmation was not matched:", c.pending)
+	}
+}
+
+func TestTransmitWake(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := newTestLocalNode(t, "127.0.0.1")
+	defer closeTestLocalNode(a)
+
+	b := newTestLocalNode(t, "127.0.0.2")
+	defer closeTestLocalNode(b)
+
+	remotes := newRemoteNodes(0)
+	remotes.update(b.packetNode(nil), sourcePacket, testPeerAddr(b), time.Now(), a, &testLog)
+
+	c := newConfirmer(a, remotes, &testLog)
+	notify := make(chan struct{}, 1)
+	wake := make(chan struct{}, 1)
+	done := make(chan struct{})
+
+	go transmitLoop(ctx, a, remotes, c, 0, false, notify, wake, make(chan []*peerAddr), done, &testLog)
+
+	tracked := func() bool {
+		for i := 0; i < 20; i++ {
+			c.lock.Lock()
+			n := len(c.pending)
+			c.lock.Unlock()
+
+			if n > 0 {
+				return true
+			}
+
+			time.Sleep(time.Millisecond * 10)
+		}
+		return false
+	}
+
+	wake <- struct{}{}
+
+	if tracked() {
+		t.Error("wake-up was tracked as a change")
+	}
+
+	notify <- struct{}{}
+
+	if !tracked() {
+		t.Error("change was not tracked")
+	}
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Flap damping, in the style of BGP route flap damping.  Each time a node
+// reappears after having failed, its penalty is increased.  A node which
+// reappears after having left gracefully has merely restarted.  The
+// penalty decays exponentially.  When it exceeds the suppress limit, the
+// node's features are hidden until the penalty has decayed below the reuse
+// limit.
+const (
+	flapPenalty       = 1000.0
+	flapSuppressLimit = 2500.0
+	flapReuseLimit    = 750.0
+
+	dampingCheckInterval = time.Second * 10
+)
+
+func decayPenalty(penalty float64, since, now time.Time, halfLife time.Duration) float64 {
+	if penalty == 0 || halfLife <= 0 {
+		return 0
+	}
+
+	return penalty * math.Exp2(-float64(now.Sub(since))/float64(halfLife))
+}
+
+// flapped penalizes a node which has reappeared.  Caller must hold the lock.
+func (remotes *remoteNodes) flapped(remote *remoteNode, now time.Time, log *Log) {
+	if remotes.flapHalfLife <= 0 {
+		return
+	}
+
+	remote.penalty = decayPenalty(remote.penalty, remote.penaltyTime, now, remotes.flapHalfLife) + flapPenalty
+	remote.penaltyTime = now
+
+	if !remote.damped && remote.penalty >= flapSuppressLimit {
+		log.Infof("%s is flapping; suppressing it (penalty %.0f)", remote, remote.penalty)
+		remote.damped = true
+	}
+}
+
+// releaseDamped stops suppressing nodes whose penalty has decayed enough.
+func (remotes *remoteNodes) releaseDamped(now time.Time, log *Log) (released bool) {
+	remotes.lock.Lock()
+	defer remotes.lock.Unlock()
+
+	for _, remote := range remotes.ipAddrs {
+		if remote.damped {
+			if penalty := decayPenalty(remote.penalty, remote.penaltyTime, now, remotes.flapHalfLife); penalty < flapReuseLimit {
+				log.Infof("%s is no longer suppressed (penalty %.0f)", remote, penalty)
+				remote.damped = false
+				released = true
+			}
+		}
+	}
+
+	return
+}
+
+func dampingLoop(ctx context.Context, remotes *remoteNodes, notify chan<- struct{}, log *Log) {
+	ticker := time.NewTicker(dampingCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if remotes.releaseDamped(time.Now(), log) {
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
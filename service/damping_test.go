@@ -0,0 +1,94 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlapDamping(t *testing.T) {
+	local := newTestLocalNode(t, "127.0.0.1")
+	defer closeTestLocalNode(local)
+
+	remotes := newRemoteNodes(0)
+	remotes.flapHalfLife = time.Minute
+
+	seq := int64(0)
+
+	flap := func() {
+		remotes.fail("10.0.0.1", seq, time.Now(), &testLog)
+		seq++
+		remotes.update(&Node{IPAddr: "10.0.0.1", Seq: seq}, sourcePacket, nil, time.Now(), local, &testLog)
+	}
+
+	seq++
+	remotes.update(&Node{IPAddr: "10.0.0.1", Seq: seq}, sourcePacket, nil, time.Now(), local, &testLog)
+
+	// Restarts aren't flaps.
+	for i := 0; i < 5; i++ {
+		seq++
+		remotes.update(&Node{IPAddr: "10.0.0.1", Seq: seq, Leaving: true}, sourcePacket, nil, time.Now(), local, &testLog)
+		seq++
+		remotes.update(&Node{IPAddr: "10.0.0.1", Seq: seq}, sourcePacket, nil, time.Now(), local, &testLog)
+	}
+
+	if status := remotes.statuses()["10.0.0.1"]; status.FlapPenalty != 0 {
+		t.Error("restart penalized:", status.FlapPenalty)
+	}
+
+	for i := 0; i < 2; i++ {
+		flap()
+	}
+
+	if len(remotes.nodes()) != 1 {
+		t.Fatal("damped too early")
+	}
+
+	flap()
+
+	if len(remotes.nodes()) != 0 || !remotes.statuses()["10.0.0.1"].Damped {
+		t.Fatal("not damped")
+	}
+
+	if remotes.releaseDamped(time.Now(), &testLog) {
+		t.Error("released too early")
+	}
+
+	// Two half-lives bring the penalty from 3000 to 750.
+	if !remotes.releaseDamped(time.Now().Add(time.Minute*2+time.Second), &testLog) {
+		t.Error("not released")
+	}
+
+	if len(remotes.nodes()) != 1 || remotes.statuses()["10.0.0.1"].Damped {
+		t.Error("still damped")
+	}
+}
+
+func TestStorageRevival(t *testing.T) {
+	local := newTestLocalNode(t, "127.0.0.1")
+	defer closeTestLocalNode(local)
+
+	remotes := newRemoteNodes(0)
+	remotes.flapHalfLife = time.Minute
+
+	for seq := int64(1); seq <= 10; seq += 2 {
+		remotes.update(&Node{IPAddr: "10.0.0.1", Seq: seq}, sourceStorage, nil, time.Now(), local, &testLog)
+		remotes.fail("10.0.0.1", seq, time.Now(), &testLog)
+		remotes.update(&Node{IPAddr: "10.0.0.1", Seq: seq + 1}, sourceStorage, nil, time.Now(), local, &testLog)
+	}
+
+	if status := remotes.statuses()["10.0.0.1"]; status.Damped || status.Membership != MemberAlive {
+		t.Errorf("%#v", status)
+	}
+}
+
+func TestDecayPenalty(t *testing.T) {
+	now := time.Now()
+
+	if p := decayPenalty(1000, now, now.Add(time.Minute), time.Minute); p != 500 {
+		t.Error(p)
+	}
+
+	if p := decayPenalty(1000, now, now, 0); p != 0 {
+		t.Error(p)
+	}
+}
@@ -0,0 +1,396 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	maxDNSUDPSize  = 512
+	dnsTCPTimeout  = time.Second * 10
+	dnsHostSubname = "host"
+)
+
+// dnsServer answers queries about features:
+//
+//	FEATURE.DOMAIN              A and AAAA records of the hosts which provide
+//	                            FEATURE, and SRV records if the feature value
+//	                            is an object with a "port" number
+//	_FEATURE._tcp.DOMAIN        SRV records
+//	_FEATURE._udp.DOMAIN        SRV records
+//	HOST.host.DOMAIN            A and AAAA records of an SRV target
+//	DOMAIN                      no records, but the name exists
+//
+// HOST is the node id of the host, or its IP address with dots and colons
+// replaced by dashes.  Feature names are matched case-insensitively.
+type dnsServer struct {
+	local   *localNode
+	remotes *remoteNodes
+	domain  string // Lower-case, with trailing dot.
+	ttl     uint32
+	log     *Log
+}
+
+func newDNSServer(local *localNode, remotes *remoteNodes, domain string, ttl time.Duration, log *Log) *dnsServer {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+
+	return &dnsServer{
+		local:   local,
+		remotes: remotes,
+		domain:  domain + ".",
+		ttl:     uint32(ttl / time.Second),
+		log:     log,
+	}
+}
+
+// initDNS listens for UDP and TCP queries.
+func initDNS(ctx context.Context, s *dnsServer, addr string) (err error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+		l.Close()
+	}()
+
+	go s.serveUDP(conn)
+	go s.serveTCP(l)
+
+	return
+}
+
+func (s *dnsServer) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 65536)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.log.Error(err)
+			}
+			return
+		}
+
+		if response := s.respond(buf[:n], maxDNSUDPSize); response != nil {
+			if _, err := conn.WriteTo(response, addr); err != nil {
+				s.log.Debugf("DNS: %s", err)
+			}
+		}
+	}
+}
+
+func (s *dnsServer) serveTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.log.Error(err)
+			}
+			return
+		}
+
+		go s.serveTCPConn(conn)
+	}
+}
+
+// serveTCPConn handles length-prefixed messages until the client closes the
+// connection or goes idle.
+func (s *dnsServer) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		conn.SetDeadline(time.Now().Add(dnsTCPTimeout))
+
+		var size uint16
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+
+		query := make([]byte, size)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		response := s.respond(query, 65535)
+		if response == nil {
+			return
+		}
+
+		buf := make([]byte, 2, 2+len(response))
+		binary.BigEndian.PutUint16(buf, uint16(len(response)))
+
+		if _, err := conn.Write(append(buf, response...)); err != nil {
+			return
+		}
+	}
+}
+
+// respond to a query, or return nil if it should be ignored.  The answers are
+// dropped and the truncation flag is set if the response doesn't fit in
+// maxSize.
+func (s *dnsServer) respond(query []byte, maxSize int) []byte {
+	var p dnsmessage.Parser
+
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+
+	response := dnsmessage.Header{
+		ID:               header.ID,
+		Response:         true,
+		OpCode:           header.OpCode,
+		Authoritative:    true,
+		RecursionDesired: header.RecursionDesired,
+	}
+
+	questions, err := p.AllQuestions()
+	if err != nil {
+		response.RCode = dnsmessage.RCodeFormatError
+		return s.build(response, nil, nil, nil)
+	}
+
+	if header.OpCode != 0 || len(questions) != 1 {
+		response.RCode = dnsmessage.RCodeNotImplemented
+		return s.build(response, questions, nil, nil)
+	}
+
+	answers, additionals, rcode := s.answer(questions[0])
+	response.RCode = rcode
+
+	data := s.build(response, questions, answers, additionals)
+	if len(data) > maxSize {
+		response.Truncated = true
+		data = s.build(response, questions, nil, nil)
+	}
+
+	return data
+}
+
+func (s *dnsServer) build(header dnsmessage.Header, questions []dnsmessage.Question, answers, additionals []dnsmessage.Resource) []byte {
+	b := dnsmessage.NewBuilder(nil, header)
+	b.EnableCompression()
+
+	b.StartQuestions()
+	for _, q := range questions {
+		b.Question(q)
+	}
+
+	b.StartAnswers()
+	for _, r := range answers {
+		addResource(&b, r)
+	}
+
+	b.StartAdditionals()
+	for _, r := range additionals {
+		addResource(&b, r)
+	}
+
+	data, err := b.Finish()
+	if err != nil {
+		s.log.Errorf("DNS: %s", err)
+		return nil
+	}
+
+	return data
+}
+
+func addResource(b *dnsmessage.Builder, r dnsmessage.Resource) {
+	switch body := r.Body.(type) {
+	case *dnsmessage.AResource:
+		b.AResource(r.Header, *body)
+
+	case *dnsmessage.AAAAResource:
+		b.AAAAResource(r.Header, *body)
+
+	case *dnsmessage.SRVResource:
+		b.SRVResource(r.Header, *body)
+	}
+}
+
+// featureHost is a visible host and its features.
+type featureHost struct {
+	name     string // Node id, or primary address with dashes.
+	ips      []net.IP
+	features map[string]*json.RawMessage
+}
+
+// featureHosts returns the local host followed by the visible remote hosts.
+func featureHosts(local *localNode, nodes []*Node) (hosts []*featureHost) {
+	add := func(id string, ipAddrs []string, features map[string]*json.RawMessage) {
+		host := &featureHost{
+			name:     id,
+			features: features,
+		}
+
+		if host.name == "" {
+			host.name = strings.NewReplacer(".", "-", ":", "-").Replace(ipAddrs[0])
+		}
+
+		for _, ipAddr := range ipAddrs {
+			if ip := net.ParseIP(ipAddr); ip != nil {
+				host.ips = append(host.ips, ip)
+			}
+		}
+
+		hosts = append(hosts, host)
+	}
+
+	add(local.id, append([]string{local.ipAddr}, local.altAddrs...), local.getNode().Features)
+
+	for _, node := range nodes {
+		add(node.Id, node.ipAddrs(), node.Features)
+	}
+
+	return
+}
+
+func (s *dnsServer) answer(q dnsmessage.Question) (answers, additionals []dnsmessage.Resource, rcode dnsmessage.RCode) {
+	name := strings.ToLower(q.Name.String())
+
+	// Queries such as SOA and NS at the apex get an authoritative answer
+	// without records.
+	if name == s.domain {
+		return
+	}
+
+	if !strings.HasSuffix(name, "."+s.domain) {
+		rcode = dnsmessage.RCodeRefused
+		return
+	}
+
+	labels := strings.Split(strings.TrimSuffix(name, "."+s.domain), ".")
+	hosts := featureHosts(s.local, s.remotes.nodes())
+
+	// HOST.host.DOMAIN
+	if len(labels) == 2 && labels[1] == dnsHostSubname {
+		for _, host := range hosts {
+			if host.name == labels[0] {
+				answers = s.addrRecords(q.Name, q.Type, host)
+				return
+			}
+		}
+
+		rcode = dnsmessage.RCodeNameError
+		return
+	}
+
+	var feature string
+	srvOnly := false
+
+	switch {
+	case len(labels) == 1:
+		feature = labels[0]
+
+	case len(labels) == 2 && strings.HasPrefix(labels[0], "_") && (labels[1] == "_tcp" || labels[1] == "_udp"):
+		feature = labels[0][1:]
+		srvOnly = true
+
+	default:
+		rcode = dnsmessage.RCodeNameError
+		return
+	}
+
+	var found bool
+
+	for _, host := range hosts {
+		value := featureValue(host.features, feature)
+		if value == nil {
+			continue
+		}
+		found = true
+
+		if q.Type == dnsmessage.TypeSRV {
+			if port := featurePort(value); port > 0 {
+				target, err := dnsmessage.NewName(host.name + "." + dnsHostSubname + "." + s.domain)
+				if err != nil {
+					continue
+				}
+
+				answers = append(answers, dnsmessage.Resource{
+					Header: s.header(q.Name, dnsmessage.TypeSRV),
+					Body:   &dnsmessage.SRVResource{Port: port, Target: target},
+				})
+
+				additionals = append(additionals, s.addrRecords(target, dnsmessage.TypeA, host)...)
+				additionals = append(additionals, s.addrRecords(target, dnsmessage.TypeAAAA, host)...)
+			}
+		} else if !srvOnly {
+			answers = append(answers, s.addrRecords(q.Name, q.Type, host)...)
+		}
+	}
+
+	if !found {
+		rcode = dnsmessage.RCodeNameError
+	}
+	return
+}
+
+// addrRecords returns the A or AAAA records of a host.
+func (s *dnsServer) addrRecords(name dnsmessage.Name, t dnsmessage.Type, host *featureHost) (records []dnsmessage.Resource) {
+	for _, ip := range host.ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			if t == dnsmessage.TypeA {
+				r := &dnsmessage.AResource{}
+				copy(r.A[:], ip4)
+				records = append(records, dnsmessage.Resource{Header: s.header(name, t), Body: r})
+			}
+		} else if t == dnsmessage.TypeAAAA {
+			r := &dnsmessage.AAAAResource{}
+			copy(r.AAAA[:], ip)
+			records = append(records, dnsmessage.Resource{Header: s.header(name, t), Body: r})
+		}
+	}
+
+	return
+}
+
+func (s *dnsServer) header(name dnsmessage.Name, t dnsmessage.Type) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{
+		Name:  name,
+		Type:  t,
+		Class: dnsmessage.ClassINET,
+		TTL:   s.ttl,
+	}
+}
+
+// featureValue finds a feature by case-insensitive name.
+func featureValue(features map[string]*json.RawMessage, name string) *json.RawMessage {
+	for feature, value := range features {
+		if value != nil && strings.EqualFold(feature, name) {
+			return value
+		}
+	}
+
+	return nil
+}
+
+// featurePort returns the "port" of a feature value, or 0.
+func featurePort(value *json.RawMessage) uint16 {
+	var params struct {
+		Port int `json:"port"`
+	}
+
+	if json.Unmarshal(*value, &params) != nil || params.Port <= 0 || params.Port > 65535 {
+		return 0
+	}
+
+	return uint16(params.Port)
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNS(t *testing.T) {
+	local := newTestLocalNode(t, "127.0.0.1")
+	defer closeTestLocalNode(local)
+
+	web := json.RawMessage(`{"port": 8080}`)
+	flag := json.RawMessage(`true`)
+
+	local.updateFeatures(map[string]*json.RawMessage{"Web": &web})
+
+	remotes := newRemoteNodes(0)
+	remotes.update(&Node{IPAddr: "10.0.0.1", Seq: 1, Features: map[string]*json.RawMessage{"web": &web, "db": &flag}}, sourcePacket, nil, time.Now(), local, &testLog)
+	remotes.update(&Node{IPAddr: "fd00::2", Seq: 1, Features: map[string]*json.RawMessage{"db": &flag}}, sourcePacket, nil, time.Now(), local, &testLog)
+
+	s := newDNSServer(local, remotes, "nameq", time.Second*5, &testLog)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go s.serveUDP(conn)
+	go s.serveTCP(l)
+
+	for name, rcode := range map[string]dnsmessage.RCode{
+		"nameq.":   dnsmessage.RCodeSuccess,
+		"NAMEQ.":   dnsmessage.RCodeSuccess,
+		"example.": dnsmessage.RCodeRefused,
+	} {
+		header, answers := testDNSQuery(t, s, name, dnsmessage.TypeSOA)
+		if header.RCode != rcode || !header.Authoritative || len(answers) != 0 {
+			t.Errorf("%s: %v %v", name, header, answers)
+		}
+	}
+
+	for network, addr := range map[string]net.Addr{"udp": conn.LocalAddr(), "tcp": l.Addr()} {
+		network, addr := network, addr
+
+		t.Run(network, func(t *testing.T) {
+			testDNSLookups(t, &net.Resolver{
+				PreferGo: true,
+				Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, addr.String())
+				},
+			})
+		})
+	}
+}
+
+func testDNSQuery(t *testing.T, s *dnsServer, name string, qtype dnsmessage.Type) (dnsmessage.Header, []dnsmessage.Resource) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	})
+
+	query, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(s.respond(query, maxDNSUDPSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	return msg.Header, msg.Answers
+}
+
+func testDNSLookups(t *testing.T, resolver *net.Resolver) {
+	ctx := context.Background()
+
+	lookup := func(name string) (addrs []string) {
+		addrs, err := resolver.LookupHost(ctx, name)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+		sort.Strings(addrs)
+		return
+	}
+
+	if addrs := lookup("db.nameq."); len(addrs) != 2 || addrs[0] != "10.0.0.1" || addrs[1] != "fd00::2" {
+		t.Errorf("db: %v", addrs)
+	}
+
+	if addrs := lookup("web.NameQ."); len(addrs) != 2 || addrs[0] != "10.0.0.1" || addrs[1] != "127.0.0.1" {
+		t.Errorf("web: %v", addrs)
+	}
+
+	if _, err := resolver.LookupHost(ctx, "nonexistent.nameq."); err == nil {
+		t.Error("nonexistent feature resolved")
+	} else if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+		t.Error(err)
+	}
+
+	for _, name := range []string{"web.nameq.", "_web._tcp.nameq."} {
+		_, srvs, err := resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if len(srvs) != 2 || srvs[0].Port != 8080 || srvs[1].Port != 8080 {
+			t.Errorf("%s: %v", name, srvs)
+		}
+
+		for _, srv := range srvs {
+			if addrs := lookup(srv.Target); len(addrs) != 1 {
+				t.Errorf("%s: %v", srv.Target, addrs)
+			}
+		}
+	}
+
+	// No port.
+	if _, srvs, _ := resolver.LookupSRV(ctx, "", "", "db.nameq."); len(srvs) != 0 {
+		t.Errorf("db: %v", srvs)
+	}
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// Event types.
+const (
+	EventFeature    = "feature"    // A feature of a host was added, updated or removed.
+	EventMembership = "membership" // Membership state of a host changed.
+	EventRemoved    = "removed"    // A host was forgotten.
+)
+
+// eventBufferSize is the number of events which may be queued for a
+// subscriber (in addition to the current state).  A subscriber which falls
+// behind is dropped.
+const eventBufferSize = 1000
+
+// Event is a JSON-compatible representation of a change.  Host is named like
+// in the state directory.  Value is nil if a feature was removed.
+type Event struct {
+	Type       string           `json:"type"`
+	Host       string           `json:"host"`
+	IPAddr     string           `json:"ip_addr"`
+	Feature    string           `json:"feature,omitempty"`
+	Value      *json.RawMessage `json:"value,omitempty"`
+	Membership *Membership      `json:"membership,omitempty"`
+}
+
+// eventHub converts successive snapshots to events, and delivers them to
+// subscribers.
+type eventHub struct {
+	lock  sync.Mutex
+	hosts map[string]*SnapshotHost
+	subs  map[chan *Event]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subs: make(map[chan *Event]struct{}),
+	}
+}
+
+// subscribe returns a channel which produces the current state, followed by
+// changes.  The channel is closed if the subscriber falls behind.
+func (h *eventHub) subscribe() chan *Event {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	events := diffHosts(nil, h.hosts)
+
+	c := make(chan *Event, len(events)+eventBufferSize)
+	for _, e := range events {
+		c <- e
+	}
+
+	h.subs[c] = struct{}{}
+	return c
+}
+
+func (h *eventHub) unsubscribe(c chan *Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, found := h.subs[c]; found {
+		delete(h.subs, c)
+		close(c)
+	}
+}
+
+func (h *eventHub) update(hosts map[string]*SnapshotHost) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	events := diffHosts(h.hosts, hosts)
+	h.hosts = hosts
+
+	for c := range h.subs {
+		if !deliver(c, events) {
+			delete(h.subs, c)
+			close(c)
+		}
+	}
+}
+
+func deliver(c chan<- *Event, events []*Event) bool {
+	for _, e := range events {
+		select {
+		case c <- e:
+
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// diffHosts returns the events which transform the old state to the new one,
+// ordered by host name and feature name.
+func diffHosts(old, new map[string]*SnapshotHost) (events []*Event) {
+	var names []string
+
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range new {
+		if _, found := old[name]; !found {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		o, n := old[name], new[name]
+
+		var oldFeatures, newFeatures map[string]*json.RawMessage
+
+		if o != nil {
+			oldFeatures = o.Features
+		}
+		if n != nil {
+			newFeatures = n.Features
+		}
+
+		if n != nil && (o == nil || o.Membership != n.Membership) {
+			m := n.Membership
+
+			events = append(events, &Event{
+				Type:       EventMembership,
+				Host:       name,
+				IPAddr:     n.IPAddr,
+				Membership: &m,
+			})
+		}
+
+		host := n
+		if host == nil {
+			host = o
+		}
+
+		for _, feature := range featureNames(oldFeatures, newFeatures) {
+			oldValue, oldFound := oldFeatures[feature]
+			newValue, newFound := newFeatures[feature]
+
+			if oldFound == newFound && sameValue(oldValue, newValue) {
+				continue
+			}
+
+			events = append(events, &Event{
+				Type:    EventFeature,
+				Host:    name,
+				IPAddr:  host.IPAddr,
+				Feature: feature,
+				Value:   newValue,
+			})
+		}
+
+		if n == nil {
+			events = append(events, &Event{
+				Type:   EventRemoved,
+				Host:   name,
+				IPAddr: o.IPAddr,
+			})
+		}
+	}
+
+	return
+}
+
+func sameValue(a, b *json.RawMessage) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return bytes.Equal(*a, *b)
+}
+
+// featureNames returns the union of the names in sorted order.
+func featureNames(a, b map[string]*json.RawMessage) (keys []string) {
+	for key := range a {
+		keys = append(keys, key)
+	}
+
+	for key := range b {
+		if _, found := a[key]; !found {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return
+}
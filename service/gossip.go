@@ -0,0 +1,177 @@
+package service
+
+import (
+	"bytes"
+	"math/bits"
+	"math/rand"
+	"time"
+)
+
+const (
+	// gossipRelayRounds is the number of transmit rounds during which a
+	// changed state is forwarded to other nodes.
+	gossipRelayRounds = 3
+
+	// gossipMaxRelayed limits the number of relayed states per round; the
+	// packet size limit usually kicks in earlier.
+	gossipMaxRelayed = 8
+
+	// minGossipInterval is the transmit interval of scalable mode while
+	// there are changes to disseminate.  The interval grows exponentially
+	// when there is nothing new, up to the normal transmit interval.
+	minGossipInterval = time.Second
+)
+
+// fanoutFor returns the number of random nodes contacted per round in
+// scalable mode, for a cluster of n nodes.  It grows logarithmically, so
+// that a change reaches all nodes in a logarithmic number of rounds.
+func fanoutFor(n int) int {
+	if f := bits.Len(uint(n)); f > 1 {
+		return f
+	}
+
+	return 1
+}
+
+// chooseTargets picks count random addresses, or all of them.
+func chooseTargets(addrs []*peerAddr, count int) []*peerAddr {
+	if count >= len(addrs) {
+		return addrs
+	}
+
+	chosen := make([]*peerAddr, len(addrs))
+	copy(chosen, addrs)
+
+	for i := 0; i < count; i++ {
+		j := i + rand.Intn(len(chosen)-i)
+		chosen[i], chosen[j] = chosen[j], chosen[i]
+	}
+
+	return chosen[:count]
+}
+
+// gossipPacer adapts the transmit interval of scalable mode.
+type gossipPacer struct {
+	interval time.Duration
+}
+
+func (p *gossipPacer) next(news bool) time.Duration {
+	if news || p.interval == 0 {
+		p.interval = minGossipInterval
+	} else {
+		p.interval *= 2
+	}
+
+	if p.interval >= minTransmitInterval {
+		p.interval = minTransmitInterval
+		return randomTransmitInterval()
+	}
+
+	return p.interval
+}
+
+// sameContent reports if two states of a node differ only in their time,
+// sequence number or signature.
+func sameContent(a, b *Node) bool {
+	if a.Id != b.Id || a.Port != b.Port || a.TLSPort != b.TLSPort || a.ProtoMin != b.ProtoMin || a.ProtoMax != b.ProtoMax || a.Leaving != b.Leaving || !bytes.Equal(a.Key, b.Key) {
+		return false
+	}
+
+	if len(a.Addrs) != len(b.Addrs) || len(a.Features) != len(b.Features) || len(a.Labels) != len(b.Labels) {
+		return false
+	}
+
+	for name, x := range a.Labels {
+		if y, found := b.Labels[name]; !found || x != y {
+			return false
+		}
+	}
+
+	for i := range a.Addrs {
+		if a.Addrs[i] != b.Addrs[i] {
+			return false
+		}
+	}
+
+	for name, x := range a.Features {
+		y, found := b.Features[name]
+		if !found || (x == nil) != (y == nil) || (x != nil && !bytes.Equal(*x, *y)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// receiveRelayed handles the third-party states included in a packet sent by
+// sender.  Only states signed by their origin are accepted, and only if the
+// origin's key is already known via S3 or a packet from the origin itself;
+// otherwise any node could introduce a node with a key of its choosing.
+func receiveRelayed(local *localNode, remotes *remoteNodes, sender *Node, relayed []*Node, log *Log) (newAddrs []*peerAddr) {
+	for _, node := range relayed {
+		if node.Sig == nil {
+			log.Errorf("unsigned state relayed by %s", sender.IPAddr)
+			continue
+		}
+
+		if !remotes.trusted(node) {
+			log.Debugf("state of %s relayed by %s isn't signed with a known key", node.IPAddr, sender.IPAddr)
+			continue
+		}
+
+		if err := verifyNodeSignature(node); err != nil {
+			log.Errorf("state relayed by %s: %s", sender.IPAddr, err)
+			continue
+		}
+
+		ipAddr, err := canonicalIPAddr(node.IPAddr)
+		if err != nil || ipAddr != node.IPAddr || ipAddr == sender.IPAddr {
+			continue
+		}
+
+		if node.Addrs, err = canonicalIPAddrs(node.Addrs); err != nil {
+			log.Errorf("state relayed by %s: %s", sender.IPAddr, err)
+			continue
+		}
+
+		if err := checkPeerAddrs(local, node); err != nil {
+			log.Errorf("state relayed by %s: %s", sender.IPAddr, err)
+			continue
+		}
+
+		node.Relayed = nil
+		node.Probe = nil
+
+		log.Debugf("%s relayed state of %s", sender.IPAddr, node.IPAddr)
+
+		if newAddr := remotes.update(node, sourceRelay, nil, time.Now(), local, log); newAddr != nil {
+			newAddrs = append(newAddrs, newAddr)
+		}
+	}
+
+	return
+}
+
+// fitRelayed finds the longest prefix of the relayed states which fits in a
+// packet.  The number of states which were kept is returned.
+func fitRelayed(local *localNode, relayed []*Node, probe *Probe, version int) (data []byte, n int) {
+	low, high := 1, len(relayed)
+
+	for low <= high {
+		mid := (low + high) / 2
+
+		candidate, err := marshalPacket(local, relayed[:mid], probe, version)
+		if err != nil {
+			panic(err)
+		}
+
+		if len(candidate) <= safeDatagramSize {
+			data, n = candidate, mid
+			low = mid + 1
+		} else {
+			high = mid - 1
+		}
+	}
+
+	return
+}
@@ -0,0 +1,405 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGossipRelay(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := json.RawMessage("true")
+
+	signed := &Node{
+		IPAddr:   "10.0.0.3",
+		TimeNs:   time.Now().UnixNano(),
+		Seq:      2,
+		Features: map[string]*json.RawMessage{"signed": &value},
+	}
+	signNode(signed, key)
+
+	forged := &Node{
+		IPAddr:   "10.0.0.4",
+		TimeNs:   time.Now().UnixNano(),
+		Seq:      2,
+		Features: map[string]*json.RawMessage{"forged": &value},
+	}
+	signNode(forged, key)
+	forged.Seq++
+
+	unknown := &Node{
+		IPAddr:   "10.0.0.5",
+		TimeNs:   time.Now().UnixNano(),
+		Seq:      2,
+		Features: map[string]*json.RawMessage{"unknown": &value},
+	}
+	signNode(unknown, key)
+
+	a := newTestLocalNode(t, "127.0.0.2", "::1")
+	defer closeTestLocalNode(a)
+
+	b := newTestBoundNode(t, "127.0.0.3", "::1")
+	defer closeTestLocalNode(b)
+
+	remotesA := newRemoteNodes(DefaultPort)
+	remotesA.update(signed, sourcePacket, nil, time.Now(), a, &testLog)
+
+	relayed := remotesA.relayable()
+	if len(relayed) != 1 {
+		t.Fatal(relayed)
+	}
+
+	// B knows the keys of the relayed nodes via S3, except the last one.
+	remotesB := newRemoteNodes(DefaultPort)
+
+	for _, ipAddr := range []string{"10.0.0.3", "10.0.0.4"} {
+		stored := &Node{IPAddr: ipAddr, Seq: 1}
+		signNode(stored, key)
+		remotesB.update(stored, sourceStorage, nil, time.Now(), b, &testLog)
+	}
+
+	notify := make(chan struct{}, 1)
+	reply := make(chan []*peerAddr, 1)
+
+	listenTestPackets(b, remotesB, OriginAddress, true, notify, reply)
+
+	transmit(a, []*peerAddr{testPeerAddr(b)}, append(relayed, forged, unknown), 1, false, &testLog)
+
+	select {
+	case <-notify:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	features := make(map[string]bool)
+	for _, node := range remotesB.nodes() {
+		for name := range node.Features {
+			features[name] = true
+		}
+	}
+
+	if len(features) != 1 || !features["signed"] {
+		t.Error(features)
+	}
+
+	if status := remotesB.statuses()["10.0.0.5"]; status != nil {
+		t.Error(status)
+	}
+
+	if relayed := remotesB.relayable(); len(relayed) != 1 || relayed[0].IPAddr != "10.0.0.3" {
+		t.Error(relayed)
+	}
+}
+
+func TestRelayBudget(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestLocalNode(t, "127.0.0.2")
+	defer closeTestLocalNode(a)
+
+	b := newTestLocalNode(t, "127.0.0.3")
+	defer closeTestLocalNode(b)
+
+	remotes := newRemoteNodes(DefaultPort)
+	value := json.RawMessage(`"` + strings.Repeat("x", 100) + `"`)
+
+	for i := 0; i < gossipMaxRelayed; i++ {
+		node := &Node{
+			IPAddr:   fmt.Sprintf("10.0.0.%d", i+1),
+			Seq:      1,
+			Features: map[string]*json.RawMessage{"test": &value},
+		}
+		signNode(node, key)
+		remotes.update(node, sourcePacket, nil, time.Now(), a, &testLog)
+	}
+
+	relayed := remotes.relayable()
+	if len(relayed) != gossipMaxRelayed {
+		t.Fatal(relayed)
+	}
+
+	_, kept := fitRelayed(a, relayed, nil, maxProtocolVersion)
+	if kept == 0 || kept == len(relayed) {
+		t.Fatalf("%d states fit", kept)
+	}
+
+	if sent := transmit(a, []*peerAddr{testPeerAddr(b)}, relayed, 1, false, &testLog); sent != kept {
+		t.Fatalf("%d states sent", sent)
+	}
+
+	remotes.spendRelays(relayed[:kept])
+
+	for i, node := range relayed {
+		relays := remotes.ipAddrs[node.IPAddr].relays
+
+		if i < kept && relays != gossipRelayRounds-1 {
+			t.Errorf("sent state %s has %d relays", node.IPAddr, relays)
+		}
+
+		if i >= kept && relays != gossipRelayRounds {
+			t.Errorf("dropped state %s has %d relays", node.IPAddr, relays)
+		}
+	}
+}
+
+// TestScalableGossip simulates scalable mode in a cluster of 1000 nodes.  One
+// node changes its features, and the change has to reach all other nodes
+// within two relay rounds: the first wave takes a logarithmic number of network
+// hops, and the next round reaches the few nodes which the first one missed.
+// Nodes transmit when their adaptive interval expires, or immediately when they
+// learn of a change.  Packets are marshaled and unmarshaled for real, so the
+// change competes for packet space with the relayed heartbeats of other nodes.
+func TestScalableGossip(t *testing.T) {
+	const (
+		size = 1000
+		hop  = time.Millisecond * 10
+	)
+
+	modes := map[int]*PacketMode{testMode.Id: testMode}
+
+	// The simulated nodes share a socket, which is never used.
+	socket := newTestLocalNode(t, "127.0.0.1")
+	defer closeTestLocalNode(socket)
+
+	type simNode struct {
+		local   *localNode
+		remotes *remoteNodes
+		pacer   gossipPacer
+		next    time.Duration
+		woken   bool
+	}
+
+	var (
+		nodes   = make([]*simNode, size)
+		addrs   = make([]*peerAddr, size)
+		indexes = make(map[*peerAddr]int)
+		loaded  = make(map[string]*Node)
+	)
+
+	for i := range nodes {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ipAddr := fmt.Sprintf("10.0.%d.%d", i/250, i%250+1)
+
+		local := &localNode{
+			ipAddr: ipAddr,
+			port:   DefaultPort,
+			udp:    socket.udp,
+			mode:   testMode,
+			key:    key,
+			clock:  new(hybridClock),
+		}
+		local.setNode(new(Node))
+
+		nodes[i] = &simNode{
+			local:   local,
+			remotes: newRemoteNodes(0),
+			next:    randomTransmitInterval(),
+		}
+
+		addrs[i] = &peerAddr{UDPAddr: &net.UDPAddr{IP: net.ParseIP(ipAddr)}}
+		indexes[addrs[i]] = i
+		loaded[ipAddr] = local.packetNode(nil)
+	}
+
+	// Everyone has loaded the old states of the others from S3.  They are
+	// stored lazily, before a node hears of another one for the first time.
+	load := func(n *simNode, ipAddr string) {
+		if n.remotes.ipAddrs[ipAddr] == nil && ipAddr != n.local.ipAddr {
+			n.remotes.update(loaded[ipAddr], sourceStorage, nil, time.Now(), n.local, &testLog)
+		}
+	}
+
+	origin := nodes[0]
+
+	for _, n := range nodes[1:] {
+		load(n, origin.local.ipAddr)
+	}
+
+	value := json.RawMessage("true")
+	origin.local.setNode(&Node{Features: map[string]*json.RawMessage{"test": &value}})
+	origin.woken = true
+
+	informed := func(n *simNode) bool {
+		for _, node := range n.remotes.nodes() {
+			if node.IPAddr == origin.local.ipAddr {
+				return node.Features["test"] != nil
+			}
+		}
+		return false
+	}
+
+	var (
+		now      time.Duration
+		hops     int
+		packets  int
+		complete bool
+	)
+
+	for !complete && now < maxTransmitInterval {
+		now += hop
+		hops++
+
+		type delivery struct {
+			to   int
+			data []byte
+		}
+
+		var deliveries []delivery
+
+		for i, n := range nodes {
+			if !n.woken && now < n.next {
+				continue
+			}
+
+			relayed := n.remotes.relayable()
+			n.next = now + n.pacer.next(n.woken || len(relayed) > 0)
+			n.woken = false
+
+			// Like transmit.
+			data, kept := fitRelayed(n.local, relayed, nil, maxProtocolVersion)
+			if data == nil {
+				var err error
+
+				if data, err = marshalPacket(n.local, nil, nil, maxProtocolVersion); err != nil {
+					t.Fatal(err)
+				}
+			}
+			n.remotes.spendRelays(relayed[:kept])
+
+			if len(data) > safeDatagramSize {
+				t.Fatalf("%d byte packet", len(data))
+			}
+
+			for _, addr := range chooseTargets(addrs, fanoutFor(size)) {
+				if to := indexes[addr]; to != i {
+					deliveries = append(deliveries, delivery{to, data})
+					packets++
+				}
+			}
+		}
+
+		for _, d := range deliveries {
+			n := nodes[d.to]
+
+			// Like receiver.receive.
+			node, _, err := unmarshalPacket(d.data, modes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			relayed := node.Relayed
+			node.Relayed = nil
+
+			load(n, node.IPAddr)
+			for _, r := range relayed {
+				load(n, r.IPAddr)
+			}
+
+			n.remotes.update(node, sourcePacket, nil, time.Now(), n.local, &testLog)
+			receiveRelayed(n.local, n.remotes, node, relayed, &testLog)
+			if n.remotes.takeNews() {
+				n.woken = true
+			}
+		}
+
+		complete = true
+		for _, n := range nodes[1:] {
+			if !informed(n) {
+				complete = false
+				break
+			}
+		}
+	}
+
+	if !complete {
+		t.Fatalf("change didn't reach all nodes in %s", now)
+	}
+
+	t.Logf("%d nodes converged in %s (%d hops at %s) with %d packets; all-to-all would take %d packets", size, now, hops, hop, packets, size*(size-1))
+
+	if limit := minGossipInterval + hop*time.Duration(2*fanoutFor(size)); now > limit {
+		t.Errorf("%s exceeds %s", now, limit)
+	}
+
+	if limit := size * fanoutFor(size) * gossipRelayRounds; packets > limit {
+		t.Errorf("%d packets exceeds %d", packets, limit)
+	}
+}
+
+func TestFanout(t *testing.T) {
+	for n, expect := range map[int]int{0: 1, 1: 1, 2: 2, 3: 2, 1000: 10} {
+		if f := fanoutFor(n); f != expect {
+			t.Errorf("%d nodes: %d", n, f)
+		}
+	}
+
+	addrs := make([]*peerAddr, 10)
+	for i := range addrs {
+		addrs[i] = new(peerAddr)
+	}
+
+	chosen := chooseTargets(addrs, 3)
+	if len(chosen) != 3 || chosen[0] == chosen[1] || chosen[1] == chosen[2] || chosen[0] == chosen[2] {
+		t.Error(chosen)
+	}
+
+	if chosen := chooseTargets(addrs, 20); len(chosen) != len(addrs) {
+		t.Error(chosen)
+	}
+}
+
+func TestGossipPacer(t *testing.T) {
+	var p gossipPacer
+
+	if d := p.next(true); d != minGossipInterval {
+		t.Error(d)
+	}
+
+	if d := p.next(false); d != minGossipInterval*2 {
+		t.Error(d)
+	}
+
+	for i := 0; i < 10; i++ {
+		p.next(false)
+	}
+
+	if d := p.next(false); d < minTransmitInterval || d > maxTransmitInterval {
+		t.Error(d)
+	}
+
+	if d := p.next(true); d != minGossipInterval {
+		t.Error(d)
+	}
+}
+
+func TestSameContent(t *testing.T) {
+	x := json.RawMessage("1")
+	y := json.RawMessage("2")
+
+	a := &Node{IPAddr: "10.0.0.1", Seq: 1, Features: map[string]*json.RawMessage{"test": &x}}
+	b := &Node{IPAddr: "10.0.0.1", Seq: 2, Features: map[string]*json.RawMessage{"test": &x}}
+	c := &Node{IPAddr: "10.0.0.1", Seq: 3, Features: map[string]*json.RawMessage{"test": &y}}
+
+	if !sameContent(a, b) {
+		t.Error("sequence number matters")
+	}
+
+	if sameContent(b, c) {
+		t.Error("feature value doesn't matter")
+	}
+}
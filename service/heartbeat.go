@@ -0,0 +1,66 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// heartbeatTimeout is the time after which a node which hasn't sent
+	// anything is forgotten.  It spans a few transmit intervals.
+	heartbeatTimeout = maxTransmitInterval * 3
+
+	// deadRetention is the time for which failed and left nodes are
+	// remembered.  Their S3 files expire by then, so they aren't loaded again.
+	deadRetention = expireTimeout
+
+	heartbeatCheckInterval = minTransmitInterval / 2
+)
+
+// heartbeatLoop expires nodes which have gone silent, and forgets dead nodes.
+// It doesn't depend on S3, so it works also when S3 is unavailable or in
+// dry-run mode.  In scalable
+// mode, a node contacts only a few nodes per round, so the timeout is
+// stretched accordingly.
+func heartbeatLoop(ctx context.Context, remotes *remoteNodes, scalable bool, notify chan<- struct{}, log *Log) {
+	ticker := time.NewTicker(heartbeatCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		timeout := heartbeatTimeout
+		if scalable {
+			timeout = scaledHeartbeatTimeout(remotes.count())
+		}
+
+		now := time.Now()
+		expired := remotes.expireSilent(now.Add(-timeout), log)
+		forgotten := remotes.forgetDead(now.Add(-deadRetention), log)
+
+		if expired || forgotten {
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// scaledHeartbeatTimeout accounts for the expected number of rounds between
+// direct transmissions from a node in a cluster of n nodes.  It isn't capped:
+// relayed heartbeats compete for packet space, so they can't be relied on, and
+// a shorter timeout would fail live nodes.  In a cluster of 1000 nodes it is
+// more than three hours, so large clusters rely on failure detection, which
+// doesn't depend on the cluster size.
+func scaledHeartbeatTimeout(n int) time.Duration {
+	if rounds := n / fanoutFor(n); rounds > 1 {
+		return heartbeatTimeout * time.Duration(rounds)
+	}
+
+	return heartbeatTimeout
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireSilent(t *testing.T) {
+	local := newTestLocalNode(t, "127.0.0.1")
+	defer closeTestLocalNode(local)
+
+	remotes := newRemoteNodes(0)
+	now := time.Now()
+
+	remotes.update(&Node{IPAddr: "10.0.0.1", Seq: 1}, sourcePacket, nil, now.Add(-heartbeatTimeout*2), local, &testLog)
+	remotes.update(&Node{IPAddr: "10.0.0.2", Seq: 1}, sourcePacket, nil, now.Add(-heartbeatTimeout*2), local, &testLog)
+	remotes.update(&Node{IPAddr: "10.0.0.2", Seq: 2}, sourceRelay, nil, now, local, &testLog)
+	remotes.update(&Node{IPAddr: "10.0.0.3", Seq: 1}, sourceStorage, nil, now.Add(-heartbeatTimeout*2), local, &testLog)
+
+	if !remotes.expireSilent(now.Add(-heartbeatTimeout), &testLog) {
+		t.Error("nothing expired")
+	}
+
+	nodes := make(map[string]bool)
+	for _, node := range remotes.nodes() {
+		nodes[node.IPAddr] = true
+	}
+
+	if nodes["10.0.0.1"] || !nodes["10.0.0.2"] || !nodes["10.0.0.3"] {
+		t.Error(nodes)
+	}
+
+	if remotes.expireSilent(now.Add(-heartbeatTimeout), &testLog) {
+		t.Error("expired again")
+	}
+
+	// The node is known only via S3, which keeps being updated.
+	remotes.update(&Node{IPAddr: "10.0.0.3", Seq: 2}, sourceStorage, nil, now, local, &testLog)
+
+	remotes.expireSilent(now.Add(heartbeatTimeout), &testLog)
+
+	if status := remotes.statuses()["10.0.0.3"]; status.Membership != MemberAlive {
+		t.Error("storage-only node expired")
+	}
+}
+
+func TestForgetDead(t *testing.T) {
+	local := newTestLocalNode(t, "127.0.0.1")
+	defer closeTestLocalNode(local)
+
+	remotes := newRemoteNodes(0)
+	now := time.Now()
+
+	remotes.update(&Node{IPAddr: "10.0.0.1", Seq: 1}, sourcePacket, nil, now.Add(-heartbeatTimeout*2), local, &testLog)
+	remotes.update(&Node{IPAddr: "10.0.0.2", Seq: 1, Leaving: true}, sourcePacket, nil, now, local, &testLog)
+	remotes.update(&Node{IPAddr: "10.0.0.3", Seq: 1}, sourcePacket, nil, now, local, &testLog)
+
+	remotes.expireSilent(now.Add(-heartbeatTimeout), &testLog)
+
+	if remotes.forgetDead(now.Add(-deadRetention), &testLog) {
+		t.Error("forgotten too early")
+	}
+
+	if remotes.count() != 3 {
+		t.Error(remotes.statuses())
+	}
+
+	if !remotes.forgetDead(time.Now().Add(time.Second), &testLog) {
+		t.Error("nothing forgotten")
+	}
+
+	statuses := remotes.statuses()
+	if len(statuses) != 1 || statuses["10.0.0.3"] == nil {
+		t.Error(statuses)
+	}
+}
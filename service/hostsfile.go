@@ -0,0 +1,144 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// hostnameFeature is a feature whose value is a name for the host.
+const hostnameFeature = "hostname"
+
+// maxDNSLabelLen is the length limit of a component of a DNS name.
+const maxDNSLabelLen = 63
+
+var (
+	hostnameRE = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+	dnsLabelRE = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+)
+
+// hostsFileWriter maintains a file in the /etc/hosts format.  All names are in
+// the domain, so that remote hosts can't override other names:
+//
+//	FEATURE-N.DOMAIN    Nth host (in order of address) which provides FEATURE
+//	HOSTNAME.DOMAIN     host whose "hostname" feature is HOSTNAME
+//	HOST.host.DOMAIN    host named like in DNS SRV targets
+type hostsFileWriter struct {
+	filename string
+	tmpDir   string
+	domain   string // Lower-case, without leading or trailing dot.
+	log      *Log
+	data     []byte // Current content.
+}
+
+func newHostsFileWriter(filename, tmpDir, domain string, log *Log) *hostsFileWriter {
+	data, _ := ioutil.ReadFile(filename)
+
+	return &hostsFileWriter{
+		filename: filename,
+		tmpDir:   tmpDir,
+		domain:   strings.ToLower(strings.Trim(domain, ".")),
+		log:      log,
+		data:     data,
+	}
+}
+
+// write the file if its content has changed.
+func (hf *hostsFileWriter) write(local *localNode, view *remoteView) {
+	data := hostsFileData(featureHosts(local, view.nodes), hf.domain)
+	if bytes.Equal(data, hf.data) {
+		return
+	}
+
+	hf.log.Debugf("updating file %s", hf.filename)
+
+	if writeStateFile(hf.filename, data, hf.tmpDir, hf.log) {
+		hf.data = data
+	}
+}
+
+// hostsFileData skips hosts without addresses, and features whose names
+// aren't valid in DNS.
+func hostsFileData(allHosts []*featureHost, domain string) []byte {
+	var hosts []*featureHost
+
+	for _, host := range allHosts {
+		if len(host.ips) > 0 {
+			hosts = append(hosts, host)
+		}
+	}
+
+	sort.Slice(hosts, func(i, j int) bool {
+		return bytes.Compare(hosts[i].ips[0].To16(), hosts[j].ips[0].To16()) < 0
+	})
+
+	names := make(map[*featureHost][]string)
+
+	add := func(host *featureHost, name string) {
+		names[host] = append(names[host], strings.ToLower(name)+"."+domain)
+	}
+
+	for _, host := range hosts {
+		var hostname string
+
+		if value := host.features[hostnameFeature]; value != nil && json.Unmarshal(*value, &hostname) == nil && len(hostname) <= 200 && hostnameRE.MatchString(hostname) {
+			add(host, hostname)
+		}
+
+		add(host, host.name+"."+dnsHostSubname)
+	}
+
+	// Feature names are case-insensitive, like in DNS.
+	found := make(map[string]bool)
+	var features []string
+
+	for _, host := range hosts {
+		for feature := range host.features {
+			feature = strings.ToLower(feature)
+			if !found[feature] && feature != hostnameFeature && dnsLabelRE.MatchString(feature) {
+				found[feature] = true
+				features = append(features, feature)
+			}
+		}
+	}
+
+	sort.Strings(features)
+
+	for _, feature := range features {
+		n := 0
+
+		for _, host := range hosts {
+			if featureValue(host.features, feature) != nil {
+				n++
+				if label := fmt.Sprintf("%s-%d", feature, n); len(label) <= maxDNSLabelLen {
+					add(host, label)
+				}
+			}
+		}
+	}
+
+	lines := make(map[string][]string)
+	var addrs []string
+
+	for _, host := range hosts {
+		for _, ip := range host.ips {
+			addr := ip.String()
+			if _, found := lines[addr]; !found {
+				addrs = append(addrs, addr)
+			}
+			lines[addr] = append(lines[addr], names[host]...)
+		}
+	}
+
+	buf := bytes.NewBufferString("# Generated by nameq.  Don't edit.\n")
+
+	for _, addr := range addrs {
+		fmt.Fprintf(buf, "%s\t%s\n", addr, strings.Join(lines[addr], " "))
+	}
+
+	return buf.Bytes()
+}
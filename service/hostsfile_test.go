@@ -0,0 +1,58 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHostsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nameq-service-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := newTestLocalNode(t, "127.0.0.1")
+	defer closeTestLocalNode(local)
+
+	web := json.RawMessage(`{"port": 8080}`)
+	name := json.RawMessage(`"db1"`)
+	bad := json.RawMessage(`"evil host"`)
+
+	local.updateFeatures(map[string]*json.RawMessage{"web": &web})
+
+	remotes := newRemoteNodes(0)
+	remotes.update(&Node{IPAddr: "10.0.0.2", Seq: 1, Features: map[string]*json.RawMessage{"web": &web, "hostname": &name}}, sourcePacket, nil, time.Now(), local, &testLog)
+	remotes.update(&Node{IPAddr: "10.0.0.10", Id: "3f2a9c0e7d614b58a1e0c4d2b6f9e871", Seq: 1, Features: map[string]*json.RawMessage{"Web": &web, "hostname": &bad, "evil host": &web, "_web": &web}}, sourcePacket, nil, time.Now(), local, &testLog)
+
+	filename := filepath.Join(dir, "hostsfile")
+
+	hf := newHostsFileWriter(filename, dir, "nameq.", &testLog)
+	hf.write(local, remotes.view())
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `# Generated by nameq.  Don't edit.
+10.0.0.2	db1.nameq 10-0-0-2.host.nameq web-1.nameq
+10.0.0.10	3f2a9c0e7d614b58a1e0c4d2b6f9e871.host.nameq web-2.nameq
+127.0.0.1	127-0-0-1.host.nameq web-3.nameq
+`
+
+	if string(data) != expect {
+		t.Errorf("%s", data)
+	}
+
+	// A host without addresses.
+	hosts := []*featureHost{{name: "x", features: map[string]*json.RawMessage{"web": &web}}}
+
+	if data := string(hostsFileData(hosts, "nameq")); data != "# Generated by nameq.  Don't edit.\n" {
+		t.Error(data)
+	}
+}
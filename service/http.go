@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// initHTTP serves the same information as the control socket, but read-only:
+//
+//	/features           features of all visible hosts by name and address
+//	/features/NAME      addresses and values of the hosts which provide NAME
+//	/nodes              statuses of remote hosts by address
+//	/health             liveness of the service, and packet counters
+//	/events             events as a server-sent event stream
+func initHTTP(ctx context.Context, a *api, addr string) (err error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+
+	server := &http.Server{
+		Handler: a.httpHandler(),
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	go func() {
+		if err := server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			a.log.Error(err)
+		}
+	}()
+
+	return
+}
+
+func (a *api) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/features", a.getOnly(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.features())
+	}))
+
+	mux.HandleFunc("/features/", a.getOnly(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/features/")
+
+		hosts, found := a.features()[name]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+
+		writeJSON(w, hosts)
+	}))
+
+	mux.HandleFunc("/nodes", a.getOnly(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.remotes.statuses())
+	}))
+
+	mux.HandleFunc("/health", a.getOnly(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"ok":    true,
+			"nodes": len(a.remotes.nodes()),
+			"stats": a.stats.values(),
+		})
+	}))
+
+	mux.HandleFunc("/events", a.getOnly(a.serveEvents))
+
+	return mux
+}
+
+func (a *api) getOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	data, err := json.MarshalIndent(value, "", "\t")
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(data, byte('\n')))
+}
+
+// serveEvents writes the current state and then changes, until the client
+// goes away or falls behind.  The event name is the event type.
+func (a *api) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events := a.hub.subscribe()
+	defer a.hub.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				a.log.Info("HTTP event subscriber fell behind")
+				return
+			}
+
+			data, err := json.Marshal(e)
+			if err != nil {
+				panic(err)
+			}
+
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+
+			// Deliver queued events in one go.
+			if len(events) == 0 {
+				flusher.Flush()
+			}
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTP(t *testing.T) {
+	local := newTestLocalNode(t, "127.0.0.1")
+	defer closeTestLocalNode(local)
+
+	value := json.RawMessage(`{"port":80}`)
+	remotes := newRemoteNodes(0)
+	remotes.update(&Node{IPAddr: "10.0.0.1", Seq: 1, Features: map[string]*json.RawMessage{"test": &value}}, sourcePacket, nil, time.Now(), local, &testLog)
+
+	hub := newEventHub()
+	hub.update(snapshotHosts(local, remotes.view(), LayoutIP))
+
+	stats := new(Stats)
+	stats.ReceivedPackets.Add(3)
+	stats.DroppedOrigin.Add(1)
+
+	a := &api{
+		local:   local,
+		remotes: remotes,
+		hub:     hub,
+		stats:   stats,
+		log:     &testLog,
+	}
+
+	server := httptest.NewServer(a.httpHandler())
+	defer server.Close()
+
+	get := func(path string, status int, result interface{}) {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != status {
+			t.Errorf("%s: %s", path, res.Status)
+			return
+		}
+
+		if result != nil {
+			if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+				t.Errorf("%s: %s", path, err)
+			}
+		}
+	}
+
+	var features map[string]map[string]struct{ Port int }
+	get("/features", http.StatusOK, &features)
+	if features["test"]["10.0.0.1"].Port != 80 {
+		t.Errorf("features: %v", features)
+	}
+
+	var hosts map[string]json.RawMessage
+	get("/features/test", http.StatusOK, &hosts)
+	if len(hosts) != 1 || hosts["10.0.0.1"] == nil {
+		t.Errorf("feature: %v", hosts)
+	}
+
+	get("/features/nonexistent", http.StatusNotFound, nil)
+
+	var statuses map[string]*NodeStatus
+	get("/nodes", http.StatusOK, &statuses)
+	if statuses["10.0.0.1"] == nil {
+		t.Errorf("nodes: %v", statuses)
+	}
+
+	var health struct {
+		OK    bool
+		Nodes int
+		Stats statsValues
+	}
+	get("/health", http.StatusOK, &health)
+	if !health.OK || health.Nodes != 1 || health.Stats.ReceivedPackets != 3 || health.Stats.DroppedOrigin != 1 {
+		t.Errorf("health: %+v", health)
+	}
+
+	if res, err := http.Post(server.URL+"/nodes", "application/json", strings.NewReader("{}")); err != nil || res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("post: %v %v", res, err)
+	}
+
+	res, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("content type: %s", ct)
+	}
+
+	lines := bufio.NewScanner(res.Body)
+
+	next := func() (name string, e *Event) {
+		for lines.Scan() {
+			line := lines.Text()
+
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				name = line[7:]
+
+			case strings.HasPrefix(line, "data: "):
+				e = new(Event)
+				if err := json.Unmarshal([]byte(line[6:]), e); err != nil {
+					t.Fatal(err)
+				}
+
+			case line == "":
+				return
+			}
+		}
+
+		t.Fatal(lines.Err())
+		return
+	}
+
+	// Current state.
+	for i := 0; i < 3; i++ {
+		if name, e := next(); name != e.Type {
+			t.Errorf("%s: %#v", name, e)
+		}
+	}
+
+	remotes.update(&Node{IPAddr: "10.0.0.1", Seq: 2, Leaving: true}, sourcePacket, nil, time.Now(), local, &testLog)
+	hub.update(snapshotHosts(local, remotes.view(), LayoutIP))
+
+	if name, e := next(); name != EventMembership || *e.Membership != MemberLeft {
+		t.Errorf("%s: %#v", name, e)
+	}
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	nodeIdSize = 16
+
+	// seqSaveInterval is the interval at which a sequence number reservation
+	// is saved.  A reservation covers two intervals, so that the numbers used
+	// before a crash stay below it.
+	seqSaveInterval = time.Minute
+)
+
+// StateLayout determines how hosts are named in the state directory.
+type StateLayout int
+
+const (
+	// LayoutIP names files by the primary IP address of the host.
+	LayoutIP StateLayout = iota
+
+	// LayoutId names files by the node ID of the host.  Hosts without an ID
+	// are named by IP address.
+	LayoutId
+)
+
+// ParseStateLayout converts "ip" or "id" to a StateLayout.
+func ParseStateLayout(s string) (layout StateLayout, err error) {
+	switch s {
+	case "ip":
+		layout = LayoutIP
+
+	case "id":
+		layout = LayoutId
+
+	default:
+		err = fmt.Errorf("unknown state layout: %s", s)
+	}
+	return
+}
+
+// name of the host in the state directory.
+func (layout StateLayout) name(ipAddr, id string) string {
+	if layout == LayoutId && id != "" {
+		return id
+	}
+
+	return ipAddr
+}
+
+// loadNodeId reads the persistent identifier of the node from a file, or
+// generates it if the file doesn't exist.  If the file can't be read or
+// created, a generated identifier is returned with the error.
+func loadNodeId(filename string) (id string, err error) {
+	data, readErr := ioutil.ReadFile(filename)
+	if readErr == nil {
+		id = string(bytes.TrimSpace(data))
+		if !validNodeId(id) {
+			id = ""
+			err = fmt.Errorf("%s: bad node id", filename)
+		}
+		return
+	}
+
+	buf := make([]byte, nodeIdSize)
+	if _, err = rand.Read(buf); err != nil {
+		return
+	}
+	id = hex.EncodeToString(buf)
+
+	if !errors.Is(readErr, os.ErrNotExist) {
+		err = readErr
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return
+	}
+
+	err = ioutil.WriteFile(filename, []byte(id+"\n"), 0644)
+	return
+}
+
+// validNodeId accepts lower-case hex strings of the generated length, so that
+// IDs can't be confused with IP addresses or path names.
+func validNodeId(id string) bool {
+	if len(id) != nodeIdSize*2 {
+		return false
+	}
+
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// seqFilename returns the path of the sequence number file which is kept next
+// to the id file.
+func seqFilename(idFilename string) string {
+	return idFilename + ".seq"
+}
+
+// loadSeq reads the sequence number saved by an earlier incarnation of the
+// node, so that a restart doesn't make them go backwards even if the clock has
+// been adjusted and S3 isn't used.  A missing file isn't an error.
+func loadSeq(filename string) (seq int64, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+
+	if seq, err = strconv.ParseInt(string(bytes.TrimSpace(data)), 10, 64); err != nil {
+		err = fmt.Errorf("%s: bad sequence number", filename)
+	}
+	return
+}
+
+// saveSeq replaces the sequence number file atomically.
+func saveSeq(filename string, seq int64) (err error) {
+	tmpname := filename + ".tmp"
+
+	if err = ioutil.WriteFile(tmpname, []byte(strconv.FormatInt(seq, 10)+"\n"), 0644); err != nil {
+		return
+	}
+
+	return os.Rename(tmpname, filename)
+}
+
+// seqLoop saves sequence number reservations until the context is done.  The
+// last actual sequence number is saved by the caller after the final packet.
+func seqLoop(ctx context.Context, local *localNode, filename string, log *Log) {
+	ticker := time.NewTicker(seqSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := saveSeq(filename, local.clock.reserve(seqSaveInterval*2)); err != nil {
+			log.Error(err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
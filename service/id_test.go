@@ -0,0 +1,188 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadNodeId(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nameq-service-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "lib", "id")
+
+	id, err := loadNodeId(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !validNodeId(id) {
+		t.Error(id)
+	}
+
+	if again, err := loadNodeId(filename); err != nil || again != id {
+		t.Error(again, err)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte("10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if id, err := loadNodeId(filename); err == nil || id != "" {
+		t.Error("bad id accepted")
+	}
+
+	// The file can't be created.
+	if id, err := loadNodeId(filepath.Join(filename, "id")); err == nil || !validNodeId(id) {
+		t.Error(id, err)
+	}
+}
+
+func TestSeqFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nameq-service-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := seqFilename(filepath.Join(dir, "id"))
+
+	if seq, err := loadSeq(filename); err != nil || seq != 0 {
+		t.Error(seq, err)
+	}
+
+	// The previous incarnation used numbers from the future.
+	old := new(hybridClock)
+	old.observe(time.Now().Add(time.Hour).UnixNano())
+	last := old.now()
+
+	if err := saveSeq(filename, old.reserve(seqSaveInterval*2)); err != nil {
+		t.Fatal(err)
+	}
+
+	seq, err := loadSeq(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := new(hybridClock)
+	clock.observe(seq)
+	if next := clock.now(); next <= last {
+		t.Errorf("reserved sequence number went backwards: %d <= %d", next, last)
+	}
+
+	if err := saveSeq(filename, clock.latest()); err != nil {
+		t.Fatal(err)
+	}
+
+	if seq, err := loadSeq(filename); err != nil || seq != clock.latest() {
+		t.Error(seq, err)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte("x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadSeq(filename); err == nil {
+		t.Error("bad sequence number accepted")
+	}
+}
+
+func TestNodeIdentity(t *testing.T) {
+	local := newTestLocalNode(t, "127.0.0.1")
+	defer closeTestLocalNode(local)
+
+	const (
+		oldId = "00000000000000000000000000000001"
+		newId = "00000000000000000000000000000002"
+	)
+
+	remotes := newRemoteNodes(0)
+	remotes.update(&Node{Id: oldId, IPAddr: "10.0.0.1", Seq: 10}, sourcePacket, nil, time.Now(), local, &testLog)
+	remotes.fail("10.0.0.1", 10, time.Now(), &testLog)
+
+	// The address is reused by a new host whose clock is behind.
+	remotes.update(&Node{Id: newId, IPAddr: "10.0.0.1", Seq: 5}, sourceRelay, nil, time.Now(), local, &testLog)
+	if status := remotes.statuses()["10.0.0.1"]; status.Id != oldId {
+		t.Error("relayed state replaced host")
+	}
+
+	remotes.update(&Node{Id: newId, IPAddr: "10.0.0.1", Seq: 5}, sourcePacket, nil, time.Now(), local, &testLog)
+	if status := remotes.statuses()["10.0.0.1"]; status.Id != newId || status.Membership != MemberAlive {
+		t.Errorf("%#v", status)
+	}
+
+	// The host changes its address.
+	remotes.update(&Node{Id: newId, IPAddr: "10.0.0.2", Seq: 6}, sourcePacket, nil, time.Now(), local, &testLog)
+	if statuses := remotes.statuses(); len(statuses) != 1 || statuses["10.0.0.2"] == nil {
+		t.Error(statuses)
+	}
+
+	// The old address is still in S3.
+	remotes.update(&Node{Id: newId, IPAddr: "10.0.0.1", Seq: 5}, sourceStorage, nil, time.Now(), local, &testLog)
+	if statuses := remotes.statuses(); len(statuses) != 1 || statuses["10.0.0.2"] == nil {
+		t.Error(statuses)
+	}
+
+	if name := LayoutId.name("10.0.0.2", newId); name != newId {
+		t.Error(name)
+	}
+
+	if name := LayoutId.name("10.0.0.3", ""); name != "10.0.0.3" {
+		t.Error(name)
+	}
+}
+
+func TestNodeIdentityKey(t *testing.T) {
+	local := newTestLocalNode(t, "127.0.0.1")
+	defer closeTestLocalNode(local)
+
+	const id = "00000000000000000000000000000001"
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := &Node{Id: id, IPAddr: "10.0.0.1", Seq: 10}
+	signNode(node, key)
+
+	remotes := newRemoteNodes(0)
+	remotes.update(node, sourcePacket, nil, time.Now(), local, &testLog)
+
+	// Another host claims the id from another address.
+	impostor := &Node{Id: id, IPAddr: "10.0.0.2", Seq: 11}
+	signNode(impostor, otherKey)
+
+	remotes.update(impostor, sourceRelay, nil, time.Now(), local, &testLog)
+	if statuses := remotes.statuses(); len(statuses) != 1 || statuses["10.0.0.1"] == nil {
+		t.Error("signed impostor moved the node:", statuses)
+	}
+
+	remotes.update(&Node{Id: id, IPAddr: "10.0.0.2", Seq: 12}, sourcePacket, nil, time.Now(), local, &testLog)
+	if statuses := remotes.statuses(); len(statuses) != 1 || statuses["10.0.0.1"] == nil {
+		t.Error("unsigned impostor moved the node:", statuses)
+	}
+
+	// The genuine host moves.
+	moved := &Node{Id: id, IPAddr: "10.0.0.3", Seq: 13}
+	signNode(moved, key)
+
+	remotes.update(moved, sourcePacket, nil, time.Now(), local, &testLog)
+	if statuses := remotes.statuses(); len(statuses) != 1 || statuses["10.0.0.3"] == nil {
+		t.Error(statuses)
+	}
+}
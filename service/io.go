@@ -2,8 +2,9 @@ package service
 
 import (
 	"context"
+	"errors"
 	"math/rand"
-	"net"
+	"sync"
 	"time"
 )
 
@@ -13,21 +14,34 @@ const (
 
 	minTransmitInterval = time.Second * 20
 	maxTransmitInterval = time.Second * 40
-
-	latencyTolerance = time.Second * 15
 )
 
 func randomTransmitInterval() time.Duration {
 	return randomDuration(minTransmitInterval, maxTransmitInterval)
 }
 
-func transmitLoop(ctx context.Context, local *localNode, remotes *remoteNodes, notify <-chan struct{}, reply <-chan []*net.UDPAddr, done chan<- struct{}, log *Log) {
+// transmitLoop sends the local state to all known nodes periodically, and to
+// new nodes immediately.  In gossip mode, recently changed states of other
+// nodes are relayed to a random subset of the nodes.  In scalable mode, each
+// round targets only a logarithmic number of random nodes which relay the
+// states further, and rounds are frequent only while there are changes to
+// disseminate.  In multicast mode, the periodic transmissions are also
+// announced to the multicast groups.  Local changes are signaled via notify;
+// wake only triggers a transmission.
+func transmitLoop(ctx context.Context, local *localNode, remotes *remoteNodes, confirmer *confirmer, fanout int, scalable bool, notify, wake <-chan struct{}, reply <-chan []*peerAddr, done chan<- struct{}, log *Log) {
 	defer func() {
-		transmit(local.empty(), remotes.addrs(), log)
+		empty := local.empty()
+		transmit(empty, remotes.addrs(), nil, 0, false, log)
+		transmit(empty, local.multicastAddrs(), nil, 0, false, log)
 		close(done)
 	}()
 
-	var replyTo []*net.UDPAddr
+	var (
+		replyTo []*peerAddr
+		pacer   gossipPacer
+		news    bool
+		change  bool
+	)
 
 	timer := time.NewTimer(randomTransmitInterval())
 
@@ -35,11 +49,36 @@ func transmitLoop(ctx context.Context, local *localNode, remotes *remoteNodes, n
 		addrs := replyTo
 		replyTo = nil
 
+		var relayed []*Node
+		relayFanout := fanout
+
 		if addrs == nil {
 			addrs = remotes.addrs()
+
+			if fanout > 0 || scalable {
+				relayed = remotes.relayable()
+			}
+
+			if scalable {
+				addrs = chooseTargets(addrs, fanoutFor(len(addrs)+1))
+				relayFanout = len(addrs)
+
+				resetTimer(timer, pacer.next(news || len(relayed) > 0))
+				news = false
+			}
+
+			transmit(local, local.multicastAddrs(), nil, 0, false, log)
+		}
+
+		if change {
+			confirmer.track(local.clock.now(), addrs)
 		}
 
-		transmit(local, addrs, log)
+		if n := transmit(local, addrs, relayed, relayFanout, change, log); n > 0 {
+			remotes.spendRelays(relayed[:n])
+		}
+
+		change = false
 
 		select {
 		case addrs := <-reply:
@@ -59,10 +98,25 @@ func transmitLoop(ctx context.Context, local *localNode, remotes *remoteNodes, n
 			}
 
 		case <-notify:
-			timer.Reset(randomTransmitInterval())
+			change = true
+
+			if scalable {
+				news = true
+			} else {
+				timer.Reset(randomTransmitInterval())
+			}
+
+		case <-wake:
+			if scalable {
+				news = true
+			} else {
+				timer.Reset(randomTransmitInterval())
+			}
 
 		case <-timer.C:
-			timer.Reset(randomTransmitInterval())
+			if !scalable {
+				timer.Reset(randomTransmitInterval())
+			}
 
 		case <-ctx.Done():
 			timer.Stop()
@@ -71,12 +125,83 @@ func transmitLoop(ctx context.Context, local *localNode, remotes *remoteNodes, n
 	}
 }
 
-func transmit(local *localNode, addrs []*net.UDPAddr, log *Log) {
-	data, err := marshalPacket(local)
-	if err != nil {
-		panic(err)
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
 	}
+	timer.Reset(d)
+}
+
+// transmit the local state.  If change is set, the receivers are asked to
+// confirm it.  The number of leading relayed states which were sent is
+// returned; a state which doesn't fit in a packet even alone counts as sent,
+// so that it doesn't hold up the others.
+func transmit(local *localNode, addrs []*peerAddr, relayed []*Node, fanout int, change bool, log *Log) (sent int) {
+	// Packets are marshaled lazily for each protocol version.
+	packets := make(map[int][]byte)
+	relayPackets := make(map[int][]byte)
+
+	for n, i := range rand.Perm(len(addrs)) {
+		addr := addrs[i]
+
+		var (
+			packet []byte
+			probe  *Probe
+		)
+
+		if change && addr.version >= confirmProtocolVersion {
+			probe = &Probe{Change: true}
+		}
+
+		if len(relayed) > 0 && n < fanout {
+			var fitted bool
 
+			if packet, fitted = relayPackets[addr.version]; !fitted {
+				var kept int
+
+				if packet, kept = fitRelayed(local, relayed, probe, addr.version); packet != nil {
+					log.Debugf("relaying %d states in packet: %d bytes", kept, len(packet))
+				} else {
+					log.Errorf("state of %s is too large to relay", relayed[0].IPAddr)
+					kept = 1
+				}
+
+				relayPackets[addr.version] = packet
+
+				if kept > sent {
+					sent = kept
+				}
+			}
+		}
+
+		if packet == nil {
+			packet = packets[addr.version]
+			if packet == nil {
+				var err error
+
+				if packet, err = marshalPacket(local, nil, probe, addr.version); err != nil {
+					panic(err)
+				}
+
+				logPacketSize(packet, log)
+				packets[addr.version] = packet
+			}
+		}
+
+		log.Debugf("sending to %s via %s", addr.IP, addr.transport)
+
+		if err := local.send(packet, addr); err != nil {
+			log.Error(err)
+		}
+	}
+
+	return
+}
+
+func logPacketSize(data []byte, log *Log) {
 	switch {
 	case len(data) > safeDatagramSize:
 		log.Errorf("sending dangerously large packet: %d bytes", len(data))
@@ -87,70 +212,166 @@ func transmit(local *localNode, addrs []*net.UDPAddr, log *Log) {
 	default:
 		log.Debugf("sending packet: %d bytes", len(data))
 	}
+}
 
-	for _, i := range rand.Perm(len(addrs)) {
-		log.Debugf("sending to %s", addrs[i].IP)
+// receiver handles packets from all transports.
+type receiver struct {
+	local     *localNode
+	remotes   *remoteNodes
+	modes     map[int]*PacketMode
+	policy    OriginPolicy
+	gossip    bool
+	prober    *prober
+	confirmer *confirmer
+	stats     *Stats
+	notify    chan<- struct{}
+	wake      chan<- struct{}
+	reply     chan<- []*peerAddr
+	log       *Log
+
+	lock    sync.Mutex
+	limiter *rateLimiter
+}
 
-		if _, err := local.conn.WriteToUDP(data, addrs[i]); err != nil {
-			log.Error(err)
-		}
+func (r *receiver) listen() {
+	r.limiter = newRateLimiter(sourcePacketRate, sourcePacketBurst)
+
+	for _, t := range r.local.transports() {
+		t.listen(r.receive, r.log)
 	}
 }
 
-func receiveLoop(local *localNode, remotes *remoteNodes, modes map[int]*PacketMode, notify chan<- struct{}, reply chan<- []*net.UDPAddr, log *Log) {
-	buf := make([]byte, maxDatagramSize)
+func (r *receiver) allow(originAddr *peerAddr) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 
-	for {
-		n, originAddr, err := local.conn.ReadFromUDP(buf)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
+	return r.limiter.allow(originAddr.IP.String(), time.Now(), r.log)
+}
+
+func (r *receiver) receive(data []byte, originAddr *peerAddr) {
+	var (
+		local   = r.local
+		remotes = r.remotes
+		stats   = r.stats
+		log     = r.log
+	)
+
+	stats.ReceivedPackets.Add(1)
 
-		data := buf[:n]
+	if !r.allow(originAddr) {
+		stats.DroppedRateLimited.Add(1)
+		return
+	}
+
+	switch {
+	case len(data) > safeDatagramSize:
+		log.Errorf("received dangerously large packet from %s: %d bytes", originAddr.IP, len(data))
+
+	case len(data) > safeDatagramSize-safeDatagramSize/4:
+		log.Infof("received large packet from %s: %d bytes", originAddr.IP, len(data))
 
+	default:
+		log.Debugf("received packet from %s: %d bytes", originAddr.IP, len(data))
+	}
+
+	if !validUnicast(originAddr.IP) {
+		stats.DroppedOrigin.Add(1)
+		log.Errorf("bad origin address: %s", originAddr.IP)
+		return
+	}
+
+	node, _, err := unmarshalPacket(data, r.modes)
+	if err != nil {
 		switch {
-		case len(data) > safeDatagramSize:
-			log.Errorf("received dangerously large packet from %s: %d bytes", originAddr.IP, len(data))
+		case errors.Is(err, errPacketInauthentic):
+			stats.DroppedInauthentic.Add(1)
 
-		case len(data) > safeDatagramSize-safeDatagramSize/4:
-			log.Infof("received large packet from %s: %d bytes", originAddr.IP, len(data))
+		case errors.Is(err, errPacketOversized):
+			stats.DroppedOversized.Add(1)
 
 		default:
-			log.Debugf("received packet from %s: %d bytes", originAddr.IP, len(data))
+			stats.DroppedMalformed.Add(1)
 		}
 
-		if !originAddr.IP.IsGlobalUnicast() {
-			log.Errorf("bad origin address: %s", originAddr.IP)
-			continue
-		}
+		log.Errorf("packet from %s: %s", originAddr.IP, err)
+		return
+	}
 
-		node, err := unmarshalPacket(data, modes)
-		if err != nil {
-			log.Error(err)
-			continue
+	if node.Sig != nil {
+		if err := verifyNodeSignature(node); err != nil {
+			stats.DroppedOrigin.Add(1)
+			log.Errorf("packet from %s: %s", originAddr.IP, err)
+			return
 		}
+	}
+
+	origin := originAddr
 
-		if err := verifyPacketOrigin(node, originAddr); err != nil {
+	if err := verifyPacketOrigin(node, originAddr.UDPAddr); err != nil {
+		switch {
+		case !errors.Is(err, errPacketOrigin):
+			stats.DroppedMalformed.Add(1)
+			log.Errorf("packet from %s: %s", originAddr.IP, err)
+			return
+
+		case r.policy == OriginAny:
+		case r.policy == OriginSignature && remotes.trusted(node):
+		default:
+			stats.DroppedOrigin.Add(1)
 			log.Error(err)
-			continue
+			return
 		}
 
-		latency := time.Now().Sub(time.Unix(0, node.TimeNs))
-		if latency > latencyTolerance {
-			log.Errorf("intolerable %s latency %s", originAddr.IP, latency)
-			continue
-		}
+		log.Debug(err)
+		origin = nil
+	}
 
-		newAddr := remotes.update(node, local, log)
+	if err := checkPeerAddrs(local, node); err != nil {
+		stats.DroppedOrigin.Add(1)
+		log.Errorf("packet from %s: %s", originAddr.IP, err)
+		return
+	}
+
+	stats.AcceptedPackets.Add(1)
+
+	relayed := node.Relayed
+	node.Relayed = nil
 
+	probe := node.Probe
+	node.Probe = nil
+
+	var newAddrs []*peerAddr
+
+	if newAddr := remotes.update(node, sourcePacket, origin, time.Now(), local, log); newAddr != nil {
+		newAddrs = append(newAddrs, newAddr)
+	}
+
+	if r.gossip && len(relayed) > 0 {
+		newAddrs = append(newAddrs, receiveRelayed(local, remotes, node, relayed, log)...)
+	}
+
+	if probe != nil && r.prober != nil {
+		r.prober.handle(node, probe)
+	}
+
+	if probe != nil && r.confirmer != nil {
+		r.confirmer.handle(node, probe)
+	}
+
+	// In scalable mode, changes are pushed onwards immediately.
+	if r.wake != nil && remotes.takeNews() {
 		select {
-		case notify <- struct{}{}:
+		case r.wake <- struct{}{}:
 		default:
 		}
+	}
 
-		if newAddr != nil {
-			reply <- []*net.UDPAddr{newAddr}
-		}
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+
+	if newAddrs != nil {
+		r.reply <- newAddrs
 	}
 }
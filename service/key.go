@@ -0,0 +1,151 @@
+package service
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// OriginPolicy determines how packets are attributed to nodes.
+type OriginPolicy int
+
+const (
+	// OriginAddress requires that packets are sent from one of the
+	// advertised addresses of the node.
+	OriginAddress OriginPolicy = iota
+
+	// OriginSignature also accepts packets from other addresses, if the
+	// node's state is signed with the key which has been associated with the
+	// node.  A node's key is learned from S3, or from its first packet which
+	// is sent from an advertised address.
+	OriginSignature
+
+	// OriginAny relies only on the shared packet secret.
+	OriginAny
+)
+
+// ParseOriginPolicy converts "address", "signature" or "any" to an
+// OriginPolicy.
+func ParseOriginPolicy(s string) (policy OriginPolicy, err error) {
+	switch s {
+	case "address":
+		policy = OriginAddress
+
+	case "signature":
+		policy = OriginSignature
+
+	case "any":
+		policy = OriginAny
+
+	default:
+		err = fmt.Errorf("unknown origin policy: %s", s)
+	}
+	return
+}
+
+// loadKey reads an Ed25519 private key seed from a file, or generates it if
+// the file doesn't exist.
+func loadKey(filename string) (key ed25519.PrivateKey, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		var seed []byte
+
+		if seed, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data))); err != nil {
+			return
+		}
+
+		if len(seed) != ed25519.SeedSize {
+			err = fmt.Errorf("%s: bad key length", filename)
+			return
+		}
+
+		key = ed25519.NewKeyFromSeed(seed)
+		return
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+
+	if _, key, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return
+	}
+
+	data = []byte(base64.StdEncoding.EncodeToString(key.Seed()) + "\n")
+	err = ioutil.WriteFile(filename, data, 0600)
+	return
+}
+
+// signedNode pins the fields covered by signatures.  A receiver re-encodes
+// the decoded state, so a field which it doesn't know about would break the
+// signature.  Don't add fields here; fields added to Node are left unsigned.
+type signedNode struct {
+	Version  int                         `json:"version,omitempty"`
+	Id       string                      `json:"id,omitempty"`
+	IPAddr   string                      `json:"ip_addr,omitempty"`
+	Addrs    []string                    `json:"addrs,omitempty"`
+	Port     int                         `json:"port,omitempty"`
+	TLSPort  int                         `json:"tls_port,omitempty"`
+	TimeNs   int64                       `json:"time_ns,omitempty"`
+	Seq      int64                       `json:"seq,omitempty"`
+	ProtoMin int                         `json:"proto_min,omitempty"`
+	ProtoMax int                         `json:"proto_max,omitempty"`
+	Features map[string]*json.RawMessage `json:"features,omitempty"`
+	Labels   map[string]string           `json:"labels,omitempty"`
+	Leaving  bool                        `json:"leaving,omitempty"`
+	Key      []byte                      `json:"key,omitempty"`
+}
+
+func signaturePayload(node *Node) []byte {
+	signed := &signedNode{
+		Version:  node.Version,
+		Id:       node.Id,
+		IPAddr:   node.IPAddr,
+		Addrs:    node.Addrs,
+		Port:     node.Port,
+		TLSPort:  node.TLSPort,
+		TimeNs:   node.TimeNs,
+		Seq:      node.Seq,
+		ProtoMin: node.ProtoMin,
+		ProtoMax: node.ProtoMax,
+		Features: node.Features,
+		Labels:   node.Labels,
+		Leaving:  node.Leaving,
+		Key:      node.Key,
+	}
+
+	data, err := json.Marshal(signed)
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+}
+
+// signNode sets the Key and Sig fields.
+func signNode(node *Node, key ed25519.PrivateKey) {
+	node.Key = key.Public().(ed25519.PublicKey)
+	node.Sig = ed25519.Sign(key, signaturePayload(node))
+}
+
+// verifyNodeSignature checks the signature against the key embedded in the
+// node, so it must be compared with the node's known key separately.
+func verifyNodeSignature(node *Node) (err error) {
+	if len(node.Key) != ed25519.PublicKeySize {
+		err = errors.New("bad public key length")
+	} else if !ed25519.Verify(ed25519.PublicKey(node.Key), signaturePayload(node), node.Sig) {
+		err = errors.New("bad signature")
+	}
+	return
+}
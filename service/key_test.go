@@ -0,0 +1,112 @@
+package service
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nameq-service-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "key")
+
+	key1, err := loadKey(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key2, err := loadKey(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(key1, key2) {
+		t.Error("key changed")
+	}
+}
+
+func TestNodeSignature(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := json.RawMessage("true")
+
+	node := &Node{
+		IPAddr:   "10.0.0.1",
+		Seq:      1,
+		Features: map[string]*json.RawMessage{"test": &value},
+	}
+
+	signNode(node, key)
+
+	if err := verifyNodeSignature(node); err != nil {
+		t.Error(err)
+	}
+
+	node.Seq++
+
+	if err := verifyNodeSignature(node); err == nil {
+		t.Error("tampered node accepted")
+	}
+}
+
+func TestOriginSignature(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Advertises an address which doesn't match the socket.
+	a, err := newLocalNode(&Params{
+		Addr:     "10.0.0.1",
+		BindAddr: "::1",
+		SendMode: testMode,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestLocalNode(a)
+
+	b := newTestLocalNode(t, "::1")
+	defer closeTestLocalNode(b)
+
+	remotes := newRemoteNodes(DefaultPort)
+
+	known := &Node{
+		IPAddr: a.ipAddr,
+		Seq:    1,
+	}
+	signNode(known, key)
+	remotes.update(known, sourceStorage, nil, time.Now(), b, &testLog)
+
+	notify := make(chan struct{}, 1)
+	reply := make(chan []*peerAddr, 1)
+
+	listenTestPackets(b, remotes, OriginSignature, false, notify, reply)
+
+	transmit(a, []*peerAddr{testPeerAddr(b)}, nil, 0, false, &testLog)
+
+	select {
+	case <-notify:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	nodes := remotes.nodes()
+	if len(nodes) != 1 || nodes[0].Seq == known.Seq {
+		t.Error(nodes)
+	}
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Per-source packet rate limit.  Each node sends a packet every 20-40
+	// seconds, and when something changes, so this is generous.
+	sourcePacketRate  = 2.0 // per second
+	sourcePacketBurst = 20.0
+
+	maxLimitedSources = 4096
+
+	// Limits for the contents of a packet.
+	maxDecompressedSize = 64 * 1024
+	maxNodeFeatures     = 1000
+	maxNodeAddrs        = 8
+	maxNodeLabels       = 32
+	maxLabelSize        = 256
+)
+
+// Stats contains counters which are updated while the service is running.
+type Stats struct {
+	ReceivedPackets atomic.Int64
+	AcceptedPackets atomic.Int64
+
+	DroppedRateLimited atomic.Int64 // Exceeded the per-source rate.
+	DroppedOversized   atomic.Int64 // Decompressed size or feature count exceeded.
+	DroppedInauthentic atomic.Int64 // Unknown mode or bad HMAC.
+	DroppedMalformed   atomic.Int64 // Bad compression, JSON or addresses.
+	DroppedOrigin      atomic.Int64 // Origin verification or signature failed.
+}
+
+// statsValues is a copy of the counters, for reporting.
+type statsValues struct {
+	ReceivedPackets    int64 `json:"received_packets"`
+	AcceptedPackets    int64 `json:"accepted_packets"`
+	DroppedRateLimited int64 `json:"dropped_rate_limited"`
+	DroppedOversized   int64 `json:"dropped_oversized"`
+	DroppedInauthentic int64 `json:"dropped_inauthentic"`
+	DroppedMalformed   int64 `json:"dropped_malformed"`
+	DroppedOrigin      int64 `json:"dropped_origin"`
+}
+
+func (stats *Stats) values() statsValues {
+	return statsValues{
+		ReceivedPackets:    stats.ReceivedPackets.Load(),
+		AcceptedPackets:    stats.AcceptedPackets.Load(),
+		DroppedRateLimited: stats.DroppedRateLimited.Load(),
+		DroppedOversized:   stats.DroppedOversized.Load(),
+		DroppedInauthentic: stats.DroppedInauthentic.Load(),
+		DroppedMalformed:   stats.DroppedMalformed.Load(),
+		DroppedOrigin:      stats.DroppedOrigin.Load(),
+	}
+}
+
+// labelsFit reports if each label is within maxLabelSize.
+func labelsFit(labels map[string]string) bool {
+	for name, value := range labels {
+		if len(name)+len(value) > maxLabelSize {
+			return false
+		}
+	}
+
+	return true
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	dropped int
+}
+
+// rateLimiter throttles packets per source address.  It isn't synchronized;
+// the transports share it via receiver.allow, which holds the receiver lock.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	sources map[string]*tokenBucket
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   burst,
+		sources: make(map[string]*tokenBucket),
+	}
+}
+
+// allow consumes a token.  The first dropped packet and the recovery are
+// logged.
+func (limiter *rateLimiter) allow(source string, now time.Time, log *Log) bool {
+	bucket := limiter.sources[source]
+	if bucket == nil {
+		if len(limiter.sources) >= maxLimitedSources {
+			limiter.purge(now)
+		}
+
+		bucket = &tokenBucket{
+			tokens:  limiter.burst,
+			updated: now,
+		}
+		limiter.sources[source] = bucket
+	} else {
+		bucket.tokens += now.Sub(bucket.updated).Seconds() * limiter.rate
+		if bucket.tokens > limiter.burst {
+			bucket.tokens = limiter.burst
+		}
+		bucket.updated = now
+	}
+
+	if bucket.tokens < 1 {
+		if bucket.dropped == 0 {
+			log.Errorf("rate limiting packets from %s", source)
+		}
+		bucket.dropped++
+		return false
+	}
+
+	if bucket.dropped > 0 {
+		log.Infof("dropped %d packets from %s due to rate limit", bucket.dropped, source)
+		bucket.dropped = 0
+	}
+
+	bucket.tokens--
+	return true
+}
+
+// purge forgets sources whose buckets would be full, or everything if that
+// doesn't help.
+func (limiter *rateLimiter) purge(now time.Time) {
+	for source, bucket := range limiter.sources {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*limiter.rate >= limiter.burst {
+			delete(limiter.sources, source)
+		}
+	}
+
+	if len(limiter.sources) >= maxLimitedSources {
+		limiter.sources = make(map[string]*tokenBucket)
+	}
+}
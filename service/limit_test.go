@@ -0,0 +1,90 @@
+package service
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/hmac"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(1, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !limiter.allow("10.0.0.1", now, &testLog) {
+			t.Fatal(i)
+		}
+	}
+
+	if limiter.allow("10.0.0.1", now, &testLog) {
+		t.Error("burst exceeded")
+	}
+
+	if !limiter.allow("10.0.0.2", now, &testLog) {
+		t.Error("other source limited")
+	}
+
+	if !limiter.allow("10.0.0.1", now.Add(time.Second), &testLog) {
+		t.Error("not refilled")
+	}
+}
+
+func TestPacketLimits(t *testing.T) {
+	modes := map[int]*PacketMode{
+		testMode.Id: testMode,
+	}
+
+	var features bytes.Buffer
+	features.WriteString(`{"ip_addr":"10.0.0.1","features":{`)
+	for i := 0; i <= maxNodeFeatures; i++ {
+		if i > 0 {
+			features.WriteString(",")
+		}
+		fmt.Fprintf(&features, `"f%d":true`, i)
+	}
+	features.WriteString("}}")
+
+	bomb := append([]byte(`{"ip_addr":"10.0.0.1"`), bytes.Repeat([]byte(" "), maxDecompressedSize)...)
+	bomb = append(bomb, '}')
+
+	label := fmt.Sprintf(`{"ip_addr":"10.0.0.1","labels":{"zone":"%s"}}`, strings.Repeat("a", maxLabelSize))
+
+	for name, message := range map[string][]byte{
+		"features": features.Bytes(),
+		"label":    []byte(label),
+		"bomb":     bomb,
+	} {
+		_, _, err := unmarshalPacket(makeTestPacket(t, message), modes)
+		if !errors.Is(err, errPacketOversized) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	if _, _, err := unmarshalPacket(makeTestPacket(t, []byte(`{"ip_addr":"10.0.0.1"}`)), modes); err != nil {
+		t.Error(err)
+	}
+}
+
+func makeTestPacket(t *testing.T, message []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(testMode.Id))
+
+	w, err := flate.NewWriterDict(&buf, flate.BestCompression, PacketCompressionDict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(message)
+	w.Close()
+
+	mac := hmac.New(sha1.New, testMode.Secret)
+	mac.Write(buf.Bytes())
+	buf.Write(mac.Sum(nil))
+
+	return buf.Bytes()
+}
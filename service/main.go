@@ -2,54 +2,142 @@ package service
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
 	"net"
+	"os"
+	"strconv"
+	"time"
 )
 
 // Default values for some Params.
 const (
-	DefaultPort       = 17106
-	DefaultFeatureDir = "/etc/nameq/features"
-	DefaultStateDir   = "/run/nameq/state"
+	DefaultPort            = 17106
+	DefaultMulticastPort   = 17107
+	DefaultMulticastGroup4 = "239.255.17.106"
+	DefaultMulticastGroup6 = "ff02::17:106"
+	DefaultFeatureDir      = "/etc/nameq/features"
+	DefaultStateDir        = "/run/nameq/state"
+	DefaultIdFile          = "/var/lib/nameq/id"
+	DefaultFlapHalfLife    = time.Minute * 5
+	DefaultConfigWindow    = time.Millisecond * 100
+	DefaultNotifyWindow    = time.Second
+	DefaultAPISocketMode   = 0660
+	DefaultHTTPBindAddr    = "127.0.0.1"
+	DefaultDNSBindAddr     = "127.0.0.1"
+	DefaultDNSDomain       = "nameq."
+	DefaultDNSTTL          = time.Second * 5
 )
 
 // Params of the service.
 type Params struct {
-	Addr         string // Required.
-	Port         int
-	Features     string
-	FeatureDir   string
-	StateDir     string
-	SendMode     *PacketMode         // Required.
-	ReceiveModes map[int]*PacketMode // Defaults to SendMode.
-	S3Creds      []byte
-	S3Region     string // Required unless S3DryRun is set.
-	S3Bucket     string // Required unless S3DryRun is set.
-	S3Prefix     string
-	S3DryRun     bool
-	Log          Log
+	Addr             string   // Required.  Advertised to other nodes.
+	AltAddrs         []string // Addresses of other families for dual-stack operation.
+	BindAddr         string   // Defaults to Addr.
+	Port             int      // Advertised to other nodes.
+	BindPort         int      // Defaults to Port.
+	Features         string
+	Labels           map[string]string // Static attributes such as region and zone.
+	FeatureDir       string
+	ConfigWindow     time.Duration // Coalesce feature config changes.
+	NotifyWindow     time.Duration // Coalesce transmissions, S3 writes and state updates caused by local changes.
+	StateDir         string
+	StateLayout      StateLayout
+	HostView         bool                // Also write the state directory grouped by host.
+	HostsFile        bool                // Write names of hosts in DNSDomain to a file in the hosts format.
+	IdFile           string              // Created if possible; the id is temporary otherwise.  States carry a node id if set.  The last sequence number is saved next to it.
+	APISocket        string              // Enables the control API.
+	APISocketMode    os.FileMode         // Defaults to DefaultAPISocketMode.
+	APIUids          []int               // Users which may make changes via the API, besides root and the service's user.
+	HTTPPort         int                 // Enables the read-only HTTP API.
+	HTTPBindAddr     string              // Defaults to DefaultHTTPBindAddr.
+	DNSPort          int                 // Enables the DNS server (UDP and TCP).
+	DNSBindAddr      string              // Defaults to DefaultDNSBindAddr.
+	DNSDomain        string              // Defaults to DefaultDNSDomain.
+	DNSTTL           time.Duration       // Time-to-live of DNS records.
+	SendMode         *PacketMode         // Required.
+	ReceiveModes     map[int]*PacketMode // Defaults to SendMode.
+	KeyFile          string              // Created if it doesn't exist.  States are signed if set.
+	OriginPolicy     OriginPolicy
+	GossipFanout     int           // Relay other nodes' signed states to this many nodes.
+	ScalableFanout   bool          // Transmit to a logarithmic number of nodes per round.  Requires KeyFile.
+	TLSCertFile      string        // Enables the TLS transport.
+	TLSKeyFile       string        // Required with TLSCertFile.
+	TLSCAFile        string        // Required with TLSCertFile.
+	TLSPort          int           // Advertised to other nodes.  Defaults to Port.
+	TLSBindPort      int           // Defaults to TLSPort.
+	TLSPeers         []string      // Networks of nodes which are contacted using TLS.
+	MulticastGroups  []string      // Enables LAN discovery.
+	MulticastPort    int           // Defaults to DefaultMulticastPort.
+	FailureDetection bool          // Probe other nodes actively.
+	SuspectGrace     time.Duration // Keep features of suspect nodes visible for this long.
+	FlapHalfLife     time.Duration // Enables flap damping.
+	Stats            *Stats        // Allocated if not set.
+	S3Creds          []byte
+	S3Region         string // Required unless S3DryRun is set.
+	S3Bucket         string // Required unless S3DryRun is set.
+	S3Prefix         string
+	S3DryRun         bool
+	Log              Log
 }
 
 // DefaultParams fills in some values.  Log is not initialized.
 func DefaultParams() *Params {
 	return &Params{
-		Addr:       GuessAddr(),
-		Port:       DefaultPort,
-		FeatureDir: DefaultFeatureDir,
-		StateDir:   DefaultStateDir,
+		Addr:             GuessAddr(),
+		Port:             DefaultPort,
+		MulticastPort:    DefaultMulticastPort,
+		FailureDetection: true,
+		FlapHalfLife:     DefaultFlapHalfLife,
+		FeatureDir:       DefaultFeatureDir,
+		ConfigWindow:     DefaultConfigWindow,
+		NotifyWindow:     DefaultNotifyWindow,
+		StateDir:         DefaultStateDir,
+		IdFile:           DefaultIdFile,
+		HTTPBindAddr:     DefaultHTTPBindAddr,
+		DNSBindAddr:      DefaultDNSBindAddr,
+		DNSDomain:        DefaultDNSDomain,
+		DNSTTL:           DefaultDNSTTL,
 	}
 }
 
 // GuessAddr tries to find a local interface suitable for the Addr parameter.
+// IPv4 is preferred over IPv6.
 func GuessAddr() string {
-	if addrs, err := net.InterfaceAddrs(); err == nil {
-		for _, addr := range addrs {
+	if addrs := GuessAddrs(); len(addrs) > 0 {
+		return addrs[0]
+	}
+
+	return ""
+}
+
+// GuessAddrs tries to find a global IPv4 address and a global IPv6 address,
+// suitable for the Addr and AltAddrs parameters of a dual-stack host.
+func GuessAddrs() (addrs []string) {
+	var ipv4, ipv6 string
+
+	if ifaceAddrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range ifaceAddrs {
 			if netAddr, ok := addr.(*net.IPNet); ok && netAddr.IP.IsGlobalUnicast() {
-				return netAddr.IP.String()
+				if isIPv4(netAddr.IP) {
+					if ipv4 == "" {
+						ipv4 = netAddr.IP.String()
+					}
+				} else {
+					if ipv6 == "" {
+						ipv6 = netAddr.IP.String()
+					}
+				}
 			}
 		}
 	}
 
-	return ""
+	for _, s := range []string{ipv4, ipv6} {
+		if s != "" {
+			addrs = append(addrs, s)
+		}
+	}
+	return
 }
 
 // Serve indefinitely.
@@ -57,12 +145,39 @@ func Serve(ctx context.Context, p *Params) (err error) {
 	if p.Port == 0 {
 		p.Port = DefaultPort
 	}
+	if p.BindPort == 0 {
+		p.BindPort = p.Port
+	}
+	if p.TLSPort == 0 {
+		p.TLSPort = p.Port
+	}
+	if p.TLSBindPort == 0 {
+		p.TLSBindPort = p.TLSPort
+	}
+	if p.MulticastPort == 0 {
+		p.MulticastPort = DefaultMulticastPort
+	}
 	if p.FeatureDir == "" {
 		p.FeatureDir = DefaultFeatureDir
 	}
 	if p.StateDir == "" {
 		p.StateDir = DefaultStateDir
 	}
+	if p.APISocketMode == 0 {
+		p.APISocketMode = DefaultAPISocketMode
+	}
+	if p.HTTPBindAddr == "" {
+		p.HTTPBindAddr = DefaultHTTPBindAddr
+	}
+	if p.DNSBindAddr == "" {
+		p.DNSBindAddr = DefaultDNSBindAddr
+	}
+	if p.DNSDomain == "" {
+		p.DNSDomain = DefaultDNSDomain
+	}
+	if p.Stats == nil {
+		p.Stats = new(Stats)
+	}
 	if p.ReceiveModes == nil {
 		p.ReceiveModes = map[int]*PacketMode{
 			p.SendMode.Id: p.SendMode,
@@ -71,51 +186,204 @@ func Serve(ctx context.Context, p *Params) (err error) {
 
 	log := &p.Log
 
-	local, err := newLocalNode(p.Addr, p.Port, p.SendMode)
+	var key ed25519.PrivateKey
+
+	if p.KeyFile != "" {
+		if key, err = loadKey(p.KeyFile); err != nil {
+			return
+		}
+	} else if p.ScalableFanout {
+		err = errors.New("scalable fanout requires a key file")
+		return
+	}
+
+	if err = checkLabels(p.Labels); err != nil {
+		return
+	}
+
+	var (
+		id      string
+		seqFile string
+	)
+
+	if p.IdFile != "" {
+		if id, err = loadNodeId(p.IdFile); err != nil {
+			if id == "" {
+				return
+			}
+
+			log.Errorf("%s; node id is not persistent", err)
+			err = nil
+		} else {
+			seqFile = seqFilename(p.IdFile)
+		}
+	}
+
+	local, err := newLocalNode(p, key)
 	if err != nil {
 		return
 	}
+	local.id = id
+
+	if seqFile != "" {
+		if seq, seqErr := loadSeq(seqFile); seqErr == nil {
+			local.clock.observe(seq)
+		} else {
+			log.Error(seqErr)
+		}
+	}
 
 	remotes := newRemoteNodes(p.Port)
+	remotes.suspectGrace = p.SuspectGrace
+	remotes.flapHalfLife = p.FlapHalfLife
 
 	var (
 		notify         = make(chan struct{}, 1)
 		notifyState    = make(chan struct{}, 1)
 		notifyStorage  = make(chan struct{}, 1)
 		notifyTransmit = make(chan struct{}, 1)
-		reply          = make(chan []*net.UDPAddr, 10)
+		wakeTransmit   = make(chan struct{}, 1)
+		resyncStorage  = make(chan struct{}, 1)
+		reply          = make(chan []*peerAddr, 10)
 		doneStorage    = make(chan struct{})
 		doneTransmit   = make(chan struct{})
 	)
 
-	if err = initFeatureConfig(local, p.Features, p.FeatureDir, notify, log); err != nil {
+	if err = initFeatureConfig(local, p.Features, p.FeatureDir, p.ConfigWindow, notify, log); err != nil {
 		return
 	}
 
-	if err = initState(local, remotes, p.StateDir, notifyState, log); err != nil {
+	var (
+		a   *api
+		hub *eventHub
+	)
+
+	if p.APISocket != "" || p.HTTPPort != 0 {
+		hub = newEventHub()
+
+		a = &api{
+			local:         local,
+			remotes:       remotes,
+			hub:           hub,
+			featureDir:    p.FeatureDir,
+			stats:         p.Stats,
+			uids:          make(map[int]bool),
+			resyncStorage: resyncStorage,
+			wakeTransmit:  wakeTransmit,
+			log:           log,
+		}
+		for _, uid := range p.APIUids {
+			a.uids[uid] = true
+		}
+	}
+
+	var hostsDomain string
+
+	if p.HostsFile {
+		hostsDomain = p.DNSDomain
+	}
+
+	if err = initState(local, remotes, p.StateDir, p.StateLayout, p.HostView, hostsDomain, hub, notifyState, log); err != nil {
 		return
 	}
 
-	go receiveLoop(local, remotes, p.ReceiveModes, notifyState, reply, log)
-	go transmitLoop(ctx, local, remotes, notifyTransmit, reply, doneTransmit, log)
+	if p.APISocket != "" {
+		if err = initAPI(ctx, a, p.APISocket, p.APISocketMode); err != nil {
+			return
+		}
+	}
+
+	if p.HTTPPort != 0 {
+		if err = initHTTP(ctx, a, net.JoinHostPort(p.HTTPBindAddr, strconv.Itoa(p.HTTPPort))); err != nil {
+			return
+		}
+	}
+
+	if p.DNSPort != 0 {
+		s := newDNSServer(local, remotes, p.DNSDomain, p.DNSTTL, log)
 
-	if err = initStorage(ctx, local, remotes, notifyStorage, reply, doneStorage, p.S3Creds, p.S3Region, p.S3Bucket, p.S3Prefix, p.S3DryRun, log); err != nil {
+		if err = initDNS(ctx, s, net.JoinHostPort(p.DNSBindAddr, strconv.Itoa(p.DNSPort))); err != nil {
+			return
+		}
+	}
+
+	prober := newProber(local, remotes, notifyState, wakeTransmit, log)
+	confirmer := newConfirmer(local, remotes, log)
+
+	r := &receiver{
+		local:     local,
+		remotes:   remotes,
+		modes:     p.ReceiveModes,
+		policy:    p.OriginPolicy,
+		gossip:    p.GossipFanout > 0 || p.ScalableFanout,
+		prober:    prober,
+		confirmer: confirmer,
+		stats:     p.Stats,
+		notify:    notifyState,
+		reply:     reply,
+		log:       log,
+	}
+	if p.ScalableFanout {
+		r.wake = wakeTransmit
+	}
+	r.listen()
+
+	if p.FailureDetection {
+		go probeLoop(ctx, prober)
+	}
+	go heartbeatLoop(ctx, remotes, p.ScalableFanout, notifyState, log)
+	if p.FlapHalfLife > 0 {
+		go dampingLoop(ctx, remotes, notifyState, log)
+	}
+	go confirmLoop(ctx, confirmer)
+	if seqFile != "" {
+		go seqLoop(ctx, local, seqFile, log)
+	}
+	go transmitLoop(ctx, local, remotes, confirmer, p.GossipFanout, p.ScalableFanout, notifyTransmit, wakeTransmit, reply, doneTransmit, log)
+
+	if err = initStorage(ctx, local, remotes, notifyStorage, resyncStorage, reply, doneStorage, p.S3Creds, p.S3Region, p.S3Bucket, p.S3Prefix, p.S3DryRun, log); err != nil {
 		return
 	}
 
+	// The first local change is forwarded immediately.  Changes which occur
+	// within the window after that are forwarded together at the end of it.
 	var (
 		forwardState    chan<- struct{}
 		forwardStorage  chan<- struct{}
 		forwardTransmit chan<- struct{}
+		wait            <-chan time.Time
+		pending         bool
 	)
 
 	for doneStorage != nil || doneTransmit != nil {
 		select {
 		case <-notify:
+			if wait != nil {
+				pending = true
+				break
+			}
+
 			forwardState = notifyState
 			forwardStorage = notifyStorage
 			forwardTransmit = notifyTransmit
 
+			if p.NotifyWindow > 0 {
+				wait = time.After(p.NotifyWindow)
+			}
+
+		case <-wait:
+			wait = nil
+
+			if pending {
+				pending = false
+
+				forwardState = notifyState
+				forwardStorage = notifyStorage
+				forwardTransmit = notifyTransmit
+
+				wait = time.After(p.NotifyWindow)
+			}
+
 		case forwardState <- struct{}{}:
 			forwardState = nil
 
@@ -133,5 +401,14 @@ func Serve(ctx context.Context, p *Params) (err error) {
 		}
 	}
 
+	// Flushes the final state queued for TLS peers.
+	local.close()
+
+	if seqFile != "" {
+		if seqErr := saveSeq(seqFile, local.clock.latest()); seqErr != nil {
+			log.Error(seqErr)
+		}
+	}
+
 	return
 }
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"fmt"
+	"time"
+)
+
+// Membership state of a remote node.
+//
+// A node is alive when its state is received.  It becomes suspect if it
+// doesn't acknowledge probes, and failed if the suspicion isn't cleared in
+// time, if another node reports it as failed, or if it goes silent.  A node
+// which shuts down in an orderly fashion has left.  Failed and left nodes
+// become alive again when they send a newer state.
+type Membership int
+
+const (
+	MemberAlive Membership = iota
+	MemberSuspect
+	MemberFailed
+	MemberLeft
+)
+
+var membershipNames = []string{
+	MemberAlive:   "alive",
+	MemberSuspect: "suspect",
+	MemberFailed:  "failed",
+	MemberLeft:    "left",
+}
+
+func (m Membership) String() string {
+	if m >= 0 && int(m) < len(membershipNames) {
+		return membershipNames[m]
+	}
+
+	return fmt.Sprintf("membership-%d", int(m))
+}
+
+func (m Membership) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Membership) UnmarshalText(text []byte) error {
+	for i, name := range membershipNames {
+		if string(text) == name {
+			*m = Membership(i)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown membership state: %q", text)
+}
+
+// membershipOf tells what a received state implies.
+func membershipOf(node *Node) Membership {
+	if node.Leaving {
+		return MemberLeft
+	}
+
+	return MemberAlive
+}
+
+// transition changes the membership state, and records the time.
+func (remote *remoteNode) transition(m Membership, now time.Time, log *Log) bool {
+	if remote.membership == m {
+		return false
+	}
+
+	log.Infof("%s: %s -> %s", remote, remote.membership, m)
+
+	remote.membership = m
+	remote.since = now
+	return true
+}
+
+// visible reports if the node's features should be exposed.  Features of a
+// suspect node are kept during the grace period, and features of a damped
+// node are hidden.
+func (remote *remoteNode) visible(now time.Time, suspectGrace time.Duration) bool {
+	if remote.damped {
+		return false
+	}
+
+	switch remote.membership {
+	case MemberAlive:
+		return true
+
+	case MemberSuspect:
+		return now.Sub(remote.since) < suspectGrace
+
+	default:
+		return false
+	}
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMembership(t *testing.T) {
+	local := newTestLocalNode(t, "127.0.0.1")
+	defer closeTestLocalNode(local)
+
+	remotes := newRemoteNodes(0)
+	now := time.Now()
+
+	membership := func() Membership {
+		return remotes.statuses()["10.0.0.1"].Membership
+	}
+
+	visible := func() bool {
+		return len(remotes.nodes()) > 0
+	}
+
+	remotes.update(&Node{IPAddr: "10.0.0.1", Seq: 1}, sourcePacket, nil, now, local, &testLog)
+	if membership() != MemberAlive || !visible() {
+		t.Fatal(membership())
+	}
+
+	remotes.suspect("10.0.0.1", now, &testLog)
+	if membership() != MemberSuspect || visible() {
+		t.Fatal(membership())
+	}
+
+	remotes.suspectGrace = time.Minute
+	if !visible() {
+		t.Error("suspect node hidden during grace period")
+	}
+
+	remotes.failSuspects(now.Add(time.Second), &testLog)
+	if membership() != MemberFailed || visible() {
+		t.Fatal(membership())
+	}
+
+	remotes.update(&Node{IPAddr: "10.0.0.1", Seq: 1}, sourceStorage, nil, now, local, &testLog)
+	if membership() != MemberFailed {
+		t.Fatal("failed node resurrected by outdated state")
+	}
+
+	remotes.update(&Node{IPAddr: "10.0.0.1", Seq: 2}, sourcePacket, nil, now, local, &testLog)
+	if membership() != MemberAlive || !visible() {
+		t.Fatal(membership())
+	}
+
+	remotes.update(&Node{IPAddr: "10.0.0.1", Seq: 3, Leaving: true}, sourcePacket, nil, now, local, &testLog)
+	if membership() != MemberLeft || visible() || len(remotes.addrs()) != 0 {
+		t.Fatal(membership())
+	}
+}
+
+func TestMembershipText(t *testing.T) {
+	for m := MemberAlive; m <= MemberLeft; m++ {
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded Membership
+
+		if err := json.Unmarshal(data, &decoded); err != nil || decoded != m {
+			t.Errorf("%s: %v %v", data, decoded, err)
+		}
+	}
+}
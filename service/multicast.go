@@ -0,0 +1,196 @@
+package service
+
+import (
+	"fmt"
+	"net"
+)
+
+// Multicast announcements are received by unknown nodes, so they are sent
+// using a fixed protocol version which all multicast-capable nodes support.
+const multicastProtocolVersion = 2
+
+// multicastTransport announces the local state to multicast groups, and
+// receives the announcements of other nodes.  Announcements are sent from the
+// unicast sockets, so that they pass origin verification and the receivers
+// learn where to reply.
+type multicastTransport struct {
+	groups []*net.UDPAddr
+	conns  []*net.UDPConn
+	udp    *udpTransport
+	self   []net.IP // Advertised local addresses.
+}
+
+// newMulticastTransport joins the groups on the interfaces of the unicast
+// sockets.  Groups of an address family without a unicast socket are skipped.
+// IPv6 groups are link-local, so if the socket isn't bound to a specific
+// address, the interface of the advertised IPv6 address is used.
+func newMulticastTransport(groups []string, port int, udp *udpTransport, ipAddrs []string) (t *multicastTransport, err error) {
+	t = &multicastTransport{
+		udp: udp,
+	}
+
+	for _, s := range ipAddrs {
+		t.self = append(t.self, net.ParseIP(s))
+	}
+
+	defer func() {
+		if err != nil {
+			t.close()
+			t = nil
+		}
+	}()
+
+	for _, s := range groups {
+		ip := net.ParseIP(s)
+		if ip == nil || !ip.IsMulticast() {
+			err = fmt.Errorf("bad multicast group: %s", s)
+			return
+		}
+
+		group := &net.UDPAddr{
+			IP:   ip,
+			Port: port,
+		}
+
+		local := udp.connFor(group)
+		if local == nil {
+			continue
+		}
+
+		var iface *net.Interface
+
+		bindIP := local.LocalAddr().(*net.UDPAddr).IP
+		if !isIPv4(ip) && bindIP.IsUnspecified() {
+			bindIP = t.selfIPv6()
+		}
+
+		if iface, err = interfaceFor(bindIP); err != nil {
+			return
+		}
+
+		network := "udp4"
+		if !isIPv4(ip) {
+			if iface == nil {
+				err = fmt.Errorf("multicast group %s needs an interface: bind or advertise an IPv6 address", s)
+				return
+			}
+
+			network = "udp6"
+			group.Zone = iface.Name
+		}
+
+		var conn *net.UDPConn
+
+		if conn, err = net.ListenMulticastUDP(network, iface, group); err != nil {
+			return
+		}
+
+		t.groups = append(t.groups, group)
+		t.conns = append(t.conns, conn)
+	}
+
+	if len(t.groups) == 0 {
+		err = fmt.Errorf("no multicast groups of local address families: %v", groups)
+	}
+	return
+}
+
+// selfIPv6 returns the first advertised IPv6 address, or the unspecified
+// address.
+func (t *multicastTransport) selfIPv6() net.IP {
+	for _, ip := range t.self {
+		if ip != nil && !isIPv4(ip) {
+			return ip
+		}
+	}
+
+	return net.IPv6unspecified
+}
+
+// interfaceFor finds the network interface which has the address.  nil is
+// returned for unspecified addresses, so that the system default is used.
+func interfaceFor(ip net.IP) (*net.Interface, error) {
+	if ip.IsUnspecified() {
+		return nil, nil
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return &ifaces[i], nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no network interface has address %s", ip)
+}
+
+// addrs returns the groups as destinations.
+func (t *multicastTransport) addrs() (addrs []*peerAddr) {
+	for _, group := range t.groups {
+		addrs = append(addrs, &peerAddr{
+			UDPAddr:   group,
+			transport: transportMulticast,
+			version:   multicastProtocolVersion,
+		})
+	}
+	return
+}
+
+// listen ignores the node's own announcements, which are looped back.  They
+// are sent from a unicast socket, whose address may be unspecified, so the
+// advertised addresses are also checked.
+func (t *multicastTransport) listen(handler packetHandler, log *Log) {
+	filtered := func(data []byte, origin *peerAddr) {
+		if t.own(origin) {
+			return
+		}
+
+		handler(data, origin)
+	}
+
+	for _, conn := range t.conns {
+		go receiveUDP(conn, filtered, log)
+	}
+}
+
+func (t *multicastTransport) own(origin *peerAddr) bool {
+	for _, conn := range t.udp.conns {
+		local := conn.LocalAddr().(*net.UDPAddr)
+		if origin.Port != local.Port {
+			continue
+		}
+
+		if origin.IP.Equal(local.IP) {
+			return true
+		}
+
+		for _, ip := range t.self {
+			if origin.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (t *multicastTransport) send(data []byte, addr *net.UDPAddr) error {
+	return t.udp.send(data, addr)
+}
+
+func (t *multicastTransport) close() {
+	for _, conn := range t.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMulticastDiscovery(t *testing.T) {
+	port := freeTestPort(t)
+
+	a := newTestMulticastNode(t, port, "127.0.0.1", "")
+	defer closeTestLocalNode(a)
+
+	// Unspecified bind address, so that own announcements must be
+	// recognized by the advertised address.
+	b := newTestMulticastNode(t, port, "127.0.0.2", "0.0.0.0")
+	defer closeTestLocalNode(b)
+
+	value := json.RawMessage("true")
+	a.updateFeatures(map[string]*json.RawMessage{"test": &value})
+
+	remotesA := newRemoteNodes(0)
+	remotesB := newRemoteNodes(0)
+	notify := make(chan struct{}, 1)
+	reply := make(chan []*peerAddr, 1)
+
+	listenTestPackets(a, remotesA, OriginAddress, false, make(chan struct{}, 1), make(chan []*peerAddr, 1))
+	listenTestPackets(b, remotesB, OriginAddress, false, notify, reply)
+
+	transmit(a, a.multicastAddrs(), nil, 0, false, &testLog)
+
+	select {
+	case <-notify:
+	case <-time.After(time.Second * 5):
+		t.Skip("multicast is not routed on loopback")
+	}
+
+	addrs := <-reply
+	if addrs[0].transport != transportUDP || addrs[0].Port != a.port {
+		t.Error(addrs[0], addrs[0].transport)
+	}
+
+	if nodes := remotesB.nodes(); len(nodes) != 1 || nodes[0].Features["test"] == nil {
+		t.Error(nodes)
+	}
+
+	if nodes := remotesA.nodes(); len(nodes) != 0 {
+		t.Error("own announcement received:", nodes)
+	}
+}
+
+func TestMulticastOwnAnnouncement(t *testing.T) {
+	local, err := newLocalNode(&Params{
+		Addr:     "10.0.0.1",
+		BindAddr: "0.0.0.0",
+		SendMode: testMode,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestLocalNode(local)
+
+	port := local.udp.conns[0].LocalAddr().(*net.UDPAddr).Port
+
+	m := &multicastTransport{
+		udp:  local.udp,
+		self: []net.IP{net.ParseIP("10.0.0.1")},
+	}
+
+	if !m.own(&peerAddr{UDPAddr: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: port}}) {
+		t.Error("own announcement accepted")
+	}
+
+	if m.own(&peerAddr{UDPAddr: &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: port}}) {
+		t.Error("announcement from another address ignored")
+	}
+
+	if m.own(&peerAddr{UDPAddr: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: port + 1}}) {
+		t.Error("announcement from another port ignored")
+	}
+}
+
+func TestMulticastGroups(t *testing.T) {
+	if _, err := newLocalNode(&Params{
+		Addr:            "127.0.0.1",
+		SendMode:        testMode,
+		MulticastGroups: []string{"127.0.0.2"},
+	}, nil); err == nil {
+		t.Error("unicast group accepted")
+	}
+
+	if _, err := newLocalNode(&Params{
+		Addr:            "127.0.0.1",
+		SendMode:        testMode,
+		MulticastGroups: []string{DefaultMulticastGroup6},
+	}, nil); err == nil {
+		t.Error("group of other address family accepted")
+	}
+}
+
+func TestMulticastIPv6Interface(t *testing.T) {
+	local, err := newLocalNode(&Params{
+		Addr:            "::1",
+		BindAddr:        "::",
+		SendMode:        testMode,
+		MulticastGroups: []string{DefaultMulticastGroup6},
+		MulticastPort:   freeTestPort(t),
+	}, nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer closeTestLocalNode(local)
+
+	iface, err := interfaceFor(net.IPv6loopback)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addrs := local.multicastAddrs(); len(addrs) != 1 || addrs[0].Zone != iface.Name {
+		t.Error(addrs)
+	}
+
+	// No interface has the advertised address.
+	if _, err := newLocalNode(&Params{
+		Addr:            "2001:db8::1",
+		BindAddr:        "::",
+		SendMode:        testMode,
+		MulticastGroups: []string{DefaultMulticastGroup6},
+	}, nil); err == nil {
+		t.Error("IPv6 group joined without an interface")
+	}
+}
+
+// newTestMulticastNode binds to an ephemeral unicast port, and advertises it.
+func newTestMulticastNode(t *testing.T, port int, ipAddr, bindAddr string) *localNode {
+	local, err := newLocalNode(&Params{
+		Addr:            ipAddr,
+		BindAddr:        bindAddr,
+		SendMode:        testMode,
+		MulticastGroups: []string{DefaultMulticastGroup4},
+		MulticastPort:   port,
+	}, nil)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	local.port = local.udp.conns[0].LocalAddr().(*net.UDPAddr).Port
+
+	return local
+}
+
+func freeTestPort(t *testing.T) int {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
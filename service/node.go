@@ -2,9 +2,11 @@ package service
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"io"
+	"math"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -13,35 +15,176 @@ import (
 )
 
 // Node is a JSON-compatible representation of a host.  IPAddr and TimeNs are
-// used when sending via UDP, but not when stored in S3.
+// used when sending via UDP, but not when stored in S3.  Addrs lists the
+// alternative addresses of a dual-stack host.  Port is set if the host doesn't
+// use the default port, and TLSPort if it accepts TLS connections.
+//
+// Seq orders the states sent by a host; it is comparable only with other
+// states of the same host.  Id is the persistent identity of the host; a
+// different Id at the same address means that the host has been replaced.
+// Labels are static attributes of the host, such as its zone.  Leaving is set
+// in the final state of a host which is shutting down.
+//
+// ProtoMin and ProtoMax advertise the supported packet protocol versions, and
+// Version is the format version of an S3 document.  Key and Sig are set if the
+// host signs its states.  Relayed contains other hosts' states in gossip mode,
+// and Probe carries failure detection messages; they are not covered by the
+// signature.
 type Node struct {
+	Version  int                         `json:"version,omitempty"`
+	Id       string                      `json:"id,omitempty"`
 	IPAddr   string                      `json:"ip_addr,omitempty"`
+	Addrs    []string                    `json:"addrs,omitempty"`
+	Port     int                         `json:"port,omitempty"`
+	TLSPort  int                         `json:"tls_port,omitempty"`
 	TimeNs   int64                       `json:"time_ns,omitempty"`
+	Seq      int64                       `json:"seq,omitempty"`
+	ProtoMin int                         `json:"proto_min,omitempty"`
+	ProtoMax int                         `json:"proto_max,omitempty"`
 	Features map[string]*json.RawMessage `json:"features,omitempty"`
+	Labels   map[string]string           `json:"labels,omitempty"`
+	Leaving  bool                        `json:"leaving,omitempty"`
+	Key      []byte                      `json:"key,omitempty"`
+	Sig      []byte                      `json:"sig,omitempty"`
+	Relayed  []*Node                     `json:"relayed,omitempty"`
+	Probe    *Probe                      `json:"probe,omitempty"`
+}
+
+// newer reports if node supersedes old.  Nodes of older versions don't send
+// sequence numbers, so their wall clock has to be trusted.
+func (node *Node) newer(old *Node) bool {
+	if node.Seq != 0 && old.Seq != 0 {
+		return node.Seq > old.Seq
+	}
+
+	return node.TimeNs > old.TimeNs
+}
+
+// ipAddrs returns the primary address followed by the alternative ones.
+func (node *Node) ipAddrs() []string {
+	return append([]string{node.IPAddr}, node.Addrs...)
 }
 
 type localNode struct {
-	ipAddr string
-	conn   *net.UDPConn
-	mode   *PacketMode
-	node   unsafe.Pointer
+	id        string
+	ipAddr    string
+	altAddrs  []string
+	port      int
+	tlsPort   int
+	tlsNets   []*net.IPNet
+	labels    map[string]string
+	udp       *udpTransport
+	tls       *tlsTransport
+	multicast *multicastTransport
+	mode      *PacketMode
+	key       ed25519.PrivateKey
+	clock     *hybridClock
+	leaving   bool
+	node      unsafe.Pointer
 }
 
-func newLocalNode(ipAddr string, port int, mode *PacketMode) (local *localNode, err error) {
-	addr, err := resolveAddr(ipAddr, port)
-	if err != nil {
-		return
+// newLocalNode binds a socket for the primary address, and one for each
+// alternative address of a dual-stack host.  The primary socket may be bound
+// to a different address than the advertised one.  TLS listeners are created
+// likewise, if TLS is configured, and multicast groups are joined if any are
+// configured.
+func newLocalNode(p *Params, key ed25519.PrivateKey) (local *localNode, err error) {
+	local = &localNode{
+		port:   p.Port,
+		labels: p.Labels,
+		udp:    new(udpTransport),
+		mode:   p.SendMode,
+		key:    key,
+		clock:  new(hybridClock),
 	}
 
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		return
+	var (
+		tlsConfig    *tls.Config
+		tlsListeners []net.Listener
+	)
+
+	if p.TLSCertFile != "" {
+		if tlsConfig, err = loadTLSConfig(p.TLSCertFile, p.TLSKeyFile, p.TLSCAFile); err != nil {
+			local = nil
+			return
+		}
+
+		if local.tlsNets, err = parseNets(p.TLSPeers); err != nil {
+			local = nil
+			return
+		}
+
+		local.tlsPort = p.TLSPort
 	}
 
-	local = &localNode{
-		ipAddr: ipAddr,
-		conn:   conn,
-		mode:   mode,
+	for i, s := range append([]string{p.Addr}, p.AltAddrs...) {
+		var canonical string
+
+		if canonical, err = canonicalIPAddr(s); err != nil {
+			break
+		}
+
+		bindAddr := s
+		if i == 0 && p.BindAddr != "" {
+			bindAddr = p.BindAddr
+		}
+
+		var addr *net.UDPAddr
+
+		if addr, err = resolveAddr(bindAddr, p.BindPort); err != nil {
+			break
+		}
+
+		// An unspecified IPv4 address would otherwise yield a dual-stack
+		// socket, which doesn't match the address family of IPv4 peers.
+		network := "udp"
+		if isIPv4(addr.IP) {
+			network = "udp4"
+		}
+
+		var conn *net.UDPConn
+
+		if conn, err = net.ListenUDP(network, addr); err != nil {
+			break
+		}
+
+		local.udp.conns = append(local.udp.conns, conn)
+
+		if tlsConfig != nil {
+			tcpAddr := &net.TCPAddr{
+				IP:   addr.IP,
+				Port: p.TLSBindPort,
+				Zone: addr.Zone,
+			}
+
+			var listener net.Listener
+
+			if listener, err = net.ListenTCP("tcp", tcpAddr); err != nil {
+				break
+			}
+
+			tlsListeners = append(tlsListeners, listener)
+		}
+
+		if i == 0 {
+			local.ipAddr = canonical
+		} else {
+			local.altAddrs = append(local.altAddrs, canonical)
+		}
+	}
+
+	if tlsConfig != nil {
+		local.tls = newTLSTransport(tlsConfig, tlsListeners, &p.Log)
+	}
+
+	if err == nil && len(p.MulticastGroups) > 0 {
+		local.multicast, err = newMulticastTransport(p.MulticastGroups, p.MulticastPort, local.udp, append([]string{local.ipAddr}, local.altAddrs...))
+	}
+
+	if err != nil {
+		local.close()
+		local = nil
+		return
 	}
 
 	local.setNode(new(Node))
@@ -53,6 +196,119 @@ func (local *localNode) String() string {
 	return local.ipAddr
 }
 
+func (local *localNode) transports() (transports []transport) {
+	transports = append(transports, local.udp)
+	if local.tls != nil {
+		transports = append(transports, local.tls)
+	}
+	if local.multicast != nil {
+		transports = append(transports, local.multicast)
+	}
+	return
+}
+
+func (local *localNode) send(data []byte, addr *peerAddr) error {
+	switch {
+	case addr.transport == transportTLS && local.tls != nil:
+		return local.tls.send(data, addr.UDPAddr)
+
+	case addr.transport == transportMulticast && local.multicast != nil:
+		return local.multicast.send(data, addr.UDPAddr)
+	}
+
+	return local.udp.send(data, addr.UDPAddr)
+}
+
+func (local *localNode) close() {
+	for _, t := range local.transports() {
+		t.close()
+	}
+}
+
+func (local *localNode) multicastAddrs() []*peerAddr {
+	if local.multicast == nil {
+		return nil
+	}
+
+	return local.multicast.addrs()
+}
+
+// useTLS reports if TLS should be used with a peer, given a packet it has
+// sent or nil.
+func (local *localNode) useTLS(node *Node, origin *peerAddr) bool {
+	if local.tls == nil || node.TLSPort == 0 {
+		return false
+	}
+
+	if origin != nil && origin.transport == transportTLS {
+		return true
+	}
+
+	ip := net.ParseIP(node.IPAddr)
+
+	for _, n := range local.tlsNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selectAddr chooses a destination address for a node.  If the node's packet
+// was sent from one of its advertised addresses, that one is used as is
+// (including the zone).  Otherwise zones of link-local addresses are borrowed
+// from the local sockets.
+func (local *localNode) selectAddr(node *Node, port int, origin *net.UDPAddr) (addr *net.UDPAddr) {
+	if node.Port != 0 {
+		port = node.Port
+	}
+
+	for _, s := range node.ipAddrs() {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			continue
+		}
+
+		candidate := &net.UDPAddr{
+			IP:   ip,
+			Port: port,
+		}
+
+		if origin != nil && ip.Equal(origin.IP) {
+			candidate.Zone = origin.Zone
+			return candidate
+		}
+
+		if addr == nil {
+			if conn := local.udp.connFor(candidate); conn != nil {
+				if ip.IsLinkLocalUnicast() {
+					candidate.Zone = conn.LocalAddr().(*net.UDPAddr).Zone
+				}
+				addr = candidate
+			}
+		}
+	}
+
+	return
+}
+
+// hasAddr reports if the canonical address is the primary or an alternative
+// address of the local node.
+func (local *localNode) hasAddr(ipAddr string) bool {
+	if ipAddr == local.ipAddr {
+		return true
+	}
+
+	for _, s := range local.altAddrs {
+		if ipAddr == s {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (local *localNode) getNode() *Node {
 	return (*Node)(atomic.LoadPointer(&local.node))
 }
@@ -61,22 +317,58 @@ func (local *localNode) setNode(node *Node) {
 	atomic.StorePointer(&local.node, unsafe.Pointer(node))
 }
 
-func (local *localNode) encodeForPacket(w io.Writer) error {
-	node := local.getNode()
+func (local *localNode) advertisedPort() int {
+	if local.port == DefaultPort {
+		return 0
+	}
+
+	return local.port
+}
 
-	return json.NewEncoder(w).Encode(&Node{
+func (local *localNode) packetNode(relayed []*Node) (node *Node) {
+	node = &Node{
+		Id:       local.id,
 		IPAddr:   local.ipAddr,
+		Addrs:    local.altAddrs,
+		Port:     local.advertisedPort(),
+		TLSPort:  local.tlsPort,
 		TimeNs:   time.Now().UnixNano(),
-		Features: node.Features,
-	})
+		Seq:      local.clock.now(),
+		ProtoMin: minProtocolVersion,
+		ProtoMax: maxProtocolVersion,
+		Features: local.getNode().Features,
+		Labels:   local.labels,
+		Leaving:  local.leaving,
+	}
+
+	if local.key != nil {
+		signNode(node, local.key)
+	}
+
+	node.Relayed = relayed
+	return
 }
 
 func (local *localNode) marshalForStorage() (data []byte, err error) {
-	node := local.getNode()
+	node := &Node{
+		Version:  storageVersion,
+		Id:       local.id,
+		Addrs:    local.altAddrs,
+		Port:     local.advertisedPort(),
+		TLSPort:  local.tlsPort,
+		Seq:      local.clock.now(),
+		ProtoMin: minProtocolVersion,
+		ProtoMax: maxProtocolVersion,
+		Features: local.getNode().Features,
+		Labels:   local.labels,
+		Leaving:  local.leaving,
+	}
+
+	if local.key != nil {
+		signNode(node, local.key)
+	}
 
-	data, err = json.MarshalIndent(&Node{
-		Features: node.Features,
-	}, "", "\t")
+	data, err = json.MarshalIndent(node, "", "\t")
 
 	if err == nil {
 		data = append(data, byte('\n'))
@@ -117,108 +409,630 @@ func (local *localNode) updateFeatures(newFeatures map[string]*json.RawMessage)
 
 func (local *localNode) empty() (empty *localNode) {
 	empty = &localNode{
-		ipAddr: local.ipAddr,
-		conn:   local.conn,
-		mode:   local.mode,
+		id:        local.id,
+		ipAddr:    local.ipAddr,
+		altAddrs:  local.altAddrs,
+		port:      local.port,
+		tlsPort:   local.tlsPort,
+		tlsNets:   local.tlsNets,
+		labels:    local.labels,
+		udp:       local.udp,
+		tls:       local.tls,
+		multicast: local.multicast,
+		mode:      local.mode,
+		key:       local.key,
+		clock:     local.clock,
+		leaving:   true,
 	}
 	empty.setNode(new(Node))
 	return
 }
 
+// nodeSource tells how a remote node's state was learned.
+type nodeSource int
+
+const (
+	sourcePacket nodeSource = iota
+	sourceStorage
+	sourceRelay
+)
+
+func (source nodeSource) String() string {
+	switch source {
+	case sourcePacket:
+		return "packet"
+
+	case sourceStorage:
+		return "s3"
+
+	case sourceRelay:
+		return "gossip"
+
+	default:
+		return fmt.Sprintf("source-%d", int(source))
+	}
+}
+
 type remoteNode struct {
-	addr *net.UDPAddr
-	node *Node
+	addr   *peerAddr
+	node   *Node
+	source nodeSource // Where the current state came from.
+	key    []byte
+
+	// relays is the number of remaining gossip rounds for the current state.
+	// news is set if the state differs from the previous one in more than
+	// its sequence number; such states are relayed first.
+	relays int
+	news   bool
+
+	// heard is the local time of the latest update, or the S3 modification
+	// time if it was loaded from there.
+	heard time.Time
+
+	// received is the local time when the node's state was last received via
+	// the network (directly or relayed).  It's zero if the node is known only
+	// via S3, which expires such nodes itself.
+	received time.Time
+
+	clockOffset  time.Duration
+	clockSampled bool
+
+	// latency is the smoothed round-trip time of direct probes.
+	latency        time.Duration
+	latencySampled bool
+
+	membership Membership
+	since      time.Time // Local time of the latest membership transition.
+
+	// deadSeq is the latest sequence number of a failed node.  Outdated
+	// states don't bring it back.
+	deadSeq int64
+
+	// Flap damping penalty as of penaltyTime.  The node's features are
+	// hidden while it's damped.
+	penalty     float64
+	penaltyTime time.Time
+	damped      bool
 }
 
 func (remote *remoteNode) String() string {
 	return remote.node.IPAddr
 }
 
+func (remote *remoteNode) status() *NodeStatus {
+	status := &NodeStatus{
+		IPAddr:            remote.node.IPAddr,
+		Id:                remote.node.Id,
+		Labels:            remote.node.Labels,
+		Membership:        remote.membership,
+		MembershipSinceNs: remote.since.UnixNano(),
+		LastSeenNs:        remote.heard.UnixNano(),
+		Source:            remote.source.String(),
+		LatencyNs:         int64(remote.latency),
+		ClockOffsetNs:     int64(remote.clockOffset),
+		ClockSkewed:       clockSkewed(remote.clockOffset),
+		Damped:            remote.damped,
+	}
+
+	if remote.addr != nil {
+		status.Transport = remote.addr.transport.String()
+		status.ProtocolVersion = remote.addr.version
+	}
+
+	return status
+}
+
 type remoteNodes struct {
 	port    int
 	lock    sync.RWMutex
 	ipAddrs map[string]*remoteNode
+	ids     map[string]*remoteNode
+
+	// suspectGrace is the time during which features of suspect nodes are
+	// still exposed.
+	suspectGrace time.Duration
+
+	// flapHalfLife is the decay rate of flap damping penalties.  Damping is
+	// disabled if it's zero.
+	flapHalfLife time.Duration
+
+	// news is set when a changed state becomes relayable.
+	news bool
 }
 
 func newRemoteNodes(port int) *remoteNodes {
 	return &remoteNodes{
 		port:    port,
 		ipAddrs: make(map[string]*remoteNode),
+		ids:     make(map[string]*remoteNode),
 	}
 }
 
 func (remotes *remoteNodes) updatable(ipAddr string, newTime time.Time) bool {
-	newTimeNs := newTime.UnixNano()
-
 	remotes.lock.RLock()
 	defer remotes.lock.RUnlock()
 
 	remote := remotes.ipAddrs[ipAddr]
-	return remote == nil || remote.node.TimeNs < newTimeNs
+	return remote == nil || remote.heard.Before(newTime)
 }
 
-func (remotes *remoteNodes) update(newNode *Node, local *localNode, log *Log) (newAddr *net.UDPAddr) {
+// trusted reports if the node's state is signed with its known key.
+func (remotes *remoteNodes) trusted(node *Node) bool {
+	remotes.lock.RLock()
+	defer remotes.lock.RUnlock()
+
+	remote := remotes.ipAddrs[node.IPAddr]
+	return remote != nil && remote.key != nil && node.Sig != nil && bytes.Equal(remote.key, node.Key)
+}
+
+// update stores a remote node's state.  origin is the source address of a
+// packet, or nil if the state was loaded from S3.  The signature must have
+// been verified by the caller.  Packets can't change a node's key, but S3 can.
+// A state with a different node id replaces the host at the address, unless
+// it was relayed.  A known node id at a new address moves the host.
+func (remotes *remoteNodes) update(newNode *Node, source nodeSource, origin *peerAddr, heard time.Time, local *localNode, log *Log) (newAddr *peerAddr) {
 	remotes.lock.Lock()
 	defer remotes.lock.Unlock()
 
-	if remote := remotes.ipAddrs[newNode.IPAddr]; remote != nil {
-		if newNode.TimeNs > remote.node.TimeNs {
-			remote.node = newNode
+	news := true
+
+	remote := remotes.ipAddrs[newNode.IPAddr]
+	if remote != nil && remote.node.Id != "" && newNode.Id != "" && remote.node.Id != newNode.Id {
+		if source == sourceRelay {
+			log.Debugf("ignoring relayed state of %s with different node id %s", remote, newNode.Id)
+			return
+		}
+
+		log.Infof("%s node %s replaced by node %s", remote, remote.node.Id, newNode.Id)
+		remotes.forget(remote)
+		remote = nil
+	}
+
+	if remote == nil {
+		if moved := remotes.ids[newNode.Id]; moved != nil && newNode.Id != "" {
+			if !newNode.newer(moved.node) {
+				log.Debugf("ignoring outdated state of node %s at %s", newNode.Id, newNode.IPAddr)
+				return
+			}
+
+			if source != sourceStorage && moved.key != nil && !bytes.Equal(moved.key, newNode.Key) {
+				log.Errorf("node %s at %s doesn't have the key of %s", newNode.Id, newNode.IPAddr, moved)
+				return
+			}
+
+			log.Infof("node %s moved from %s to %s", newNode.Id, moved, newNode.IPAddr)
+			remotes.forget(moved)
+		}
+
+		newAddr = remotes.peerAddr(newNode, origin, local, log)
+
+		remote = &remoteNode{
+			addr:       newAddr,
+			node:       newNode,
+			source:     source,
+			membership: membershipOf(newNode),
+			since:      time.Now(),
 		}
+
+		remotes.ipAddrs[newNode.IPAddr] = remote
 	} else {
-		newAddr, _ = resolveAddr(newNode.IPAddr, remotes.port)
+		if source != sourceStorage && remote.key != nil && newNode.Sig != nil && !bytes.Equal(remote.key, newNode.Key) {
+			log.Errorf("%s key mismatch", remote)
+			return
+		}
+
+		if remote.membership == MemberFailed && newNode.Seq != 0 && newNode.Seq <= remote.deadSeq {
+			log.Debugf("ignoring outdated state of failed node %s", remote)
+			return
+		}
+
+		if newNode.newer(remote.node) {
+			news = !sameContent(remote.node, newNode)
+
+			remote.node = newNode
+			remote.source = source
+			remote.addr = remotes.peerAddr(newNode, origin, local, log)
+
+			now := time.Now()
+			wasFailed := remote.membership == MemberFailed
+
+			// S3 lags behind, so it may revive a node which has just failed.
+			if remote.transition(membershipOf(newNode), now, log) && wasFailed && remote.present() && source != sourceStorage {
+				remotes.flapped(remote, now, log)
+			}
+		} else if source != sourceStorage {
+			log.Debugf("ignoring outdated state of %s", remote)
+			return
+		}
+	}
+
+	if newNode.Id != "" && remote.node == newNode {
+		remotes.ids[newNode.Id] = remote
+	}
+
+	if newNode.Sig != nil && source != sourceStorage && remote.node == newNode {
+		remote.news = news || (remote.news && remote.relays > 0)
+		remote.relays = gossipRelayRounds
 
-		remotes.ipAddrs[newNode.IPAddr] = &remoteNode{
-			addr: newAddr,
-			node: newNode,
+		if news {
+			remotes.news = true
+		}
+	}
+
+	if newNode.Sig != nil && !bytes.Equal(remote.key, newNode.Key) {
+		if remote.key != nil {
+			log.Infof("%s key changed", remote)
+		}
+		remote.key = newNode.Key
+	}
+
+	if heard.After(remote.heard) {
+		remote.heard = heard
+	}
+
+	if source != sourceStorage && heard.After(remote.received) {
+		remote.received = heard
+	}
+
+	if source == sourcePacket && newNode.TimeNs != 0 {
+		oldSkewed := remote.clockSampled && clockSkewed(remote.clockOffset)
+
+		sample := time.Unix(0, newNode.TimeNs).Sub(heard)
+		remote.clockOffset = smoothClockOffset(remote.clockOffset, sample, !remote.clockSampled)
+		remote.clockSampled = true
+
+		switch newSkewed := clockSkewed(remote.clockOffset); {
+		case newSkewed && !oldSkewed:
+			log.Errorf("%s clock is off by %s", remote, remote.clockOffset)
+
+		case !newSkewed && oldSkewed:
+			log.Infof("%s clock is back in sync", remote)
 		}
 	}
 
 	return
 }
 
-func (remotes *remoteNodes) expire(threshold time.Time, local *localNode, log *Log) {
-	thresholdNs := threshold.UnixNano()
+// peerAddr chooses the destination, the transport and the protocol version
+// for a node.
+func (remotes *remoteNodes) peerAddr(node *Node, origin *peerAddr, local *localNode, log *Log) *peerAddr {
+	version := negotiateVersion(node)
+	if version == 0 {
+		log.Errorf("%s supports protocol versions %d-%d", node.IPAddr, node.ProtoMin, node.ProtoMax)
+		return nil
+	}
+
+	var originAddr *net.UDPAddr
+	if origin != nil {
+		originAddr = origin.UDPAddr
+	}
+
+	addr := local.selectAddr(node, remotes.port, originAddr)
+	if addr == nil {
+		return nil
+	}
+
+	kind := transportUDP
+
+	if local.useTLS(node, origin) {
+		kind = transportTLS
+		addr.Port = node.TLSPort
+	}
 
+	return &peerAddr{
+		UDPAddr:   addr,
+		transport: kind,
+		version:   version,
+		ipAddr:    node.IPAddr,
+	}
+}
+
+func (remotes *remoteNodes) expire(threshold time.Time, local *localNode, log *Log) {
 	remotes.lock.Lock()
 	defer remotes.lock.Unlock()
 
 	var expired []*remoteNode
 
 	for _, remote := range remotes.ipAddrs {
-		if remote.node.TimeNs < thresholdNs {
+		if remote.heard.Before(threshold) {
 			log.Infof("expiring %s", remote)
 			expired = append(expired, remote)
 		}
 	}
 
 	for _, remote := range expired {
-		delete(remotes.ipAddrs, remote.node.IPAddr)
+		remotes.forget(remote)
+	}
+}
+
+// forget removes a node.  Caller must hold the lock.
+func (remotes *remoteNodes) forget(remote *remoteNode) {
+	delete(remotes.ipAddrs, remote.node.IPAddr)
+
+	if remotes.ids[remote.node.Id] == remote {
+		delete(remotes.ids, remote.node.Id)
+	}
+}
+
+// expireSilent declares the nodes failed which haven't been heard from via
+// the network since the threshold.  Nodes known only via S3 are left alone.
+func (remotes *remoteNodes) expireSilent(threshold time.Time, log *Log) (expired bool) {
+	remotes.lock.Lock()
+	defer remotes.lock.Unlock()
+
+	for _, remote := range remotes.ipAddrs {
+		if remote.present() && !remote.received.IsZero() && remote.received.Before(threshold) {
+			log.Infof("%s has been silent since %s", remote, remote.received.Format(time.RFC3339))
+			remote.fail(remote.node.Seq, time.Now(), log)
+			expired = true
+		}
+	}
+
+	return
+}
+
+// forgetDead removes the failed and left nodes which haven't come back since
+// the threshold.
+func (remotes *remoteNodes) forgetDead(threshold time.Time, log *Log) (forgotten bool) {
+	remotes.lock.Lock()
+	defer remotes.lock.Unlock()
+
+	var dead []*remoteNode
+
+	for _, remote := range remotes.ipAddrs {
+		if !remote.present() && remote.since.Before(threshold) {
+			log.Infof("forgetting %s", remote)
+			dead = append(dead, remote)
+		}
+	}
+
+	for _, remote := range dead {
+		remotes.forget(remote)
+	}
+
+	return len(dead) > 0
+}
+
+// observeLatency updates the round-trip time estimate of a node.
+func (remotes *remoteNodes) observeLatency(ipAddr string, rtt time.Duration) {
+	remotes.lock.Lock()
+	defer remotes.lock.Unlock()
+
+	if remote := remotes.ipAddrs[ipAddr]; remote != nil {
+		remote.latency = smoothLatency(remote.latency, rtt, !remote.latencySampled)
+		remote.latencySampled = true
+	}
+}
+
+// probeable lists the nodes which support failure detection.
+func (remotes *remoteNodes) probeable() (ipAddrs []string) {
+	remotes.lock.RLock()
+	defer remotes.lock.RUnlock()
+
+	for ipAddr, remote := range remotes.ipAddrs {
+		if remote.probeable() {
+			ipAddrs = append(ipAddrs, ipAddr)
+		}
+	}
+
+	return
+}
+
+func (remote *remoteNode) probeable() bool {
+	return remote.present() && remote.addr != nil && remote.addr.version >= probeProtocolVersion
+}
+
+// present reports if the node is alive or suspect.
+func (remote *remoteNode) present() bool {
+	return remote.membership == MemberAlive || remote.membership == MemberSuspect
+}
+
+func (remote *remoteNode) fail(seq int64, now time.Time, log *Log) {
+	remote.transition(MemberFailed, now, log)
+	remote.deadSeq = seq
+	remote.relays = 0
+}
+
+// probeAddr returns the address of a node which supports failure detection,
+// or nil.
+func (remotes *remoteNodes) probeAddr(ipAddr string) *peerAddr {
+	remotes.lock.RLock()
+	defer remotes.lock.RUnlock()
+
+	if remote := remotes.ipAddrs[ipAddr]; remote != nil && remote.probeable() {
+		return remote.addr
+	}
+
+	return nil
+}
+
+// probeHelpers chooses random nodes for probing the target indirectly.
+func (remotes *remoteNodes) probeHelpers(target string, count int) (addrs []*peerAddr) {
+	remotes.lock.RLock()
+	defer remotes.lock.RUnlock()
+
+	// Map iteration order is random enough.
+	for ipAddr, remote := range remotes.ipAddrs {
+		if len(addrs) >= count {
+			break
+		}
+
+		if ipAddr != target && remote.probeable() && remote.membership == MemberAlive {
+			addrs = append(addrs, remote.addr)
+		}
+	}
+
+	return
+}
+
+// suspect marks an alive node as suspect.
+func (remotes *remoteNodes) suspect(ipAddr string, now time.Time, log *Log) bool {
+	remotes.lock.Lock()
+	defer remotes.lock.Unlock()
+
+	remote := remotes.ipAddrs[ipAddr]
+	if remote == nil || remote.membership != MemberAlive {
+		return false
 	}
+
+	return remote.transition(MemberSuspect, now, log)
 }
 
-func (remotes *remoteNodes) addrs() (addrs []*net.UDPAddr) {
+// failSuspects declares the nodes failed which have been suspected since
+// before the threshold.  Their latest sequence numbers are returned.
+func (remotes *remoteNodes) failSuspects(threshold time.Time, log *Log) (failed map[string]int64) {
+	remotes.lock.Lock()
+	defer remotes.lock.Unlock()
+
+	for ipAddr, remote := range remotes.ipAddrs {
+		if remote.membership == MemberSuspect && remote.since.Before(threshold) {
+			if failed == nil {
+				failed = make(map[string]int64)
+			}
+			failed[ipAddr] = remote.node.Seq
+
+			remote.fail(remote.node.Seq, time.Now(), log)
+		}
+	}
+
+	return
+}
+
+// fail declares a node failed based on another node's report, unless a newer
+// state has been received.
+func (remotes *remoteNodes) fail(ipAddr string, seq int64, now time.Time, log *Log) bool {
+	remotes.lock.Lock()
+	defer remotes.lock.Unlock()
+
+	remote := remotes.ipAddrs[ipAddr]
+	if remote == nil || !remote.present() || remote.node.Seq > seq {
+		return false
+	}
+
+	log.Infof("%s has failed according to another node", remote)
+
+	remote.fail(seq, now, log)
+	return true
+}
+
+func (remotes *remoteNodes) addrs() (addrs []*peerAddr) {
 	remotes.lock.RLock()
 	defer remotes.lock.RUnlock()
 
 	for _, remote := range remotes.ipAddrs {
-		addrs = append(addrs, remote.addr)
+		if remote.present() && remote.addr != nil {
+			addrs = append(addrs, remote.addr)
+		}
 	}
 
 	return
 }
 
-func (remotes *remoteNodes) nodes() (nodes []*Node) {
+// relayable returns recently changed signed states, for forwarding them to
+// other nodes.  The final states of nodes which have left are relayed too.
+// The rounds are spent by spendRelays, after the states have been sent.
+func (remotes *remoteNodes) relayable() (nodes []*Node) {
 	remotes.lock.RLock()
 	defer remotes.lock.RUnlock()
 
+	// Changed states take precedence over mere sequence number updates.
+	for _, news := range []bool{true, false} {
+		for _, remote := range remotes.ipAddrs {
+			if remote.relays > 0 && remote.news == news && len(nodes) < gossipMaxRelayed {
+				nodes = append(nodes, remote.node)
+			}
+		}
+	}
+
+	return
+}
+
+// spendRelays uses up a relay round of the states.  States which have been
+// replaced in the meantime keep their rounds.
+func (remotes *remoteNodes) spendRelays(nodes []*Node) {
+	remotes.lock.Lock()
+	defer remotes.lock.Unlock()
+
+	for _, node := range nodes {
+		if remote := remotes.ipAddrs[node.IPAddr]; remote != nil && remote.node == node && remote.relays > 0 {
+			remote.relays--
+		}
+	}
+}
+
+// takeNews reports if there are changed states to relay since the previous
+// call.
+func (remotes *remoteNodes) takeNews() (news bool) {
+	remotes.lock.Lock()
+	defer remotes.lock.Unlock()
+
+	news = remotes.news
+	remotes.news = false
+	return
+}
+
+func (remotes *remoteNodes) count() int {
+	remotes.lock.RLock()
+	defer remotes.lock.RUnlock()
+
+	return len(remotes.ipAddrs)
+}
+
+// nodes returns the states whose features are exposed.
+func (remotes *remoteNodes) nodes() []*Node {
+	remotes.lock.RLock()
+	defer remotes.lock.RUnlock()
+
+	return remotes.visibleNodes(time.Now())
+}
+
+func (remotes *remoteNodes) statuses() map[string]*NodeStatus {
+	remotes.lock.RLock()
+	defer remotes.lock.RUnlock()
+
+	return remotes.nodeStatuses(time.Now())
+}
+
+// remoteView is a consistent copy of the remote nodes.
+type remoteView struct {
+	statuses map[string]*NodeStatus // All nodes by address.
+	nodes    []*Node                // Visible nodes.
+}
+
+// view returns the statuses and the visible states as of the same moment.
+func (remotes *remoteNodes) view() *remoteView {
+	remotes.lock.RLock()
+	defer remotes.lock.RUnlock()
+
+	now := time.Now()
+
+	return &remoteView{
+		statuses: remotes.nodeStatuses(now),
+		nodes:    remotes.visibleNodes(now),
+	}
+}
+
+// visibleNodes returns the states of the visible nodes.  Caller must hold the
+// lock.
+func (remotes *remoteNodes) visibleNodes(now time.Time) (nodes []*Node) {
 	for _, remote := range remotes.ipAddrs {
-		nodes = append(nodes, remote.node)
+		if remote.visible(now, remotes.suspectGrace) {
+			nodes = append(nodes, remote.node)
+		}
 	}
 
 	return
 }
 
-func resolveAddr(ipAddr string, port int) (addr *net.UDPAddr, err error) {
-	return net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", ipAddr, port))
+// nodeStatuses returns the statuses of all nodes.  Caller must hold the lock.
+func (remotes *remoteNodes) nodeStatuses(now time.Time) (statuses map[string]*NodeStatus) {
+	statuses = make(map[string]*NodeStatus)
+
+	for ipAddr, remote := range remotes.ipAddrs {
+		status := remote.status()
+		status.FlapPenalty = math.Round(decayPenalty(remote.penalty, remote.penaltyTime, now, remotes.flapHalfLife))
+		statuses[ipAddr] = status
+	}
+
+	return
 }
@@ -5,36 +5,109 @@ import (
 	"compress/flate"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
 	"net"
 )
 
 // PacketMode specifies a shared UDP packet configuration.
 type PacketMode struct {
 	Id     int    // Identifies the configuration.  Must be in range [0..255].
-	Secret []byte // The shared HMAC-SHA1 key.
+	Secret []byte // The shared HMAC key.
 }
 
+// Packet protocol versions:
+//
+//  1. Mode id, DEFLATE-compressed JSON (PacketCompressionDict), HMAC-SHA1.
+//  2. Mode id, version, DEFLATE-compressed JSON (PacketCompressionDictV2),
+//     HMAC-SHA256.
+//  3. Same as 2.  Failure detection probes may be included.
+//  4. Same as 3.  Changes may be confirmed.
+//
+// Nodes advertise the range of versions they support, and each packet is sent
+// using the highest version supported by both ends.  Nodes which don't
+// advertise anything support only version 1.
+const (
+	minProtocolVersion = 1
+	maxProtocolVersion = 4
+)
+
+// S3 document format version.  Documents without a version are from nodes
+// which don't know about versions; they are compatible.
+const (
+	storageVersion = 1
+)
+
 var (
-	// Preset dictionary used for compressing UDP packets with DEFLATE.
+	errPacketMalformed   = errors.New("packet is malformed")
+	errPacketInauthentic = errors.New("packet is inauthentic")
+	errPacketOversized   = errors.New("packet is too large")
+	errPacketOrigin      = errors.New("packet address doesn't match origin")
+)
+
+var (
+	// Preset dictionary used for compressing UDP packets with DEFLATE
+	// (protocol version 1).
 	PacketCompressionDict = []byte("{\"ip_addr\":\",\"time_ns\":,\"names\":[\",\"],\"features\":{\":true,\"}}}")
+
+	// Preset dictionary used for compressing UDP packets with DEFLATE
+	// (protocol version 2).
+	PacketCompressionDictV2 = []byte("{\"ip_addr\":\",\"addrs\":[\"\"],\"port\":,\"time_ns\":,\"seq\":,\"proto_min\":1,\"proto_max\":2,\"features\":{\":true,\"}},\"key\":\"\",\"sig\":\"\",\"relayed\":[{\"}]}")
 )
 
-func marshalPacket(local *localNode) (data []byte, err error) {
+// negotiateVersion picks the highest protocol version supported by both ends,
+// or returns zero.
+func negotiateVersion(node *Node) int {
+	min, max := node.ProtoMin, node.ProtoMax
+	if max == 0 {
+		min, max = 1, 1
+	}
+
+	if max > maxProtocolVersion {
+		max = maxProtocolVersion
+	}
+
+	if max < min || max < minProtocolVersion {
+		return 0
+	}
+
+	return max
+}
+
+func marshalPacket(local *localNode, relayed []*Node, probe *Probe, version int) (data []byte, err error) {
+	node := local.packetNode(relayed)
+	node.Probe = probe
+	return encodePacket(node, local.mode, version)
+}
+
+func encodePacket(node *Node, mode *PacketMode, version int) (data []byte, err error) {
 	var buf bytes.Buffer
-	buf.WriteByte(byte(local.mode.Id))
+	buf.WriteByte(byte(mode.Id))
+
+	dict := PacketCompressionDict
+	newHash := sha1.New
+
+	if version >= 2 {
+		buf.WriteByte(byte(version))
+		dict = PacketCompressionDictV2
+		newHash = sha256.New
+	}
 
-	inflater, err := flate.NewWriterDict(&buf, flate.DefaultCompression, PacketCompressionDict)
+	inflater, err := flate.NewWriterDict(&buf, flate.DefaultCompression, dict)
 	if err != nil {
 		return
 	}
-	if err = local.encodeForPacket(inflater); err != nil {
+	if err = json.NewEncoder(inflater).Encode(node); err != nil {
 		return
 	}
 	inflater.Close()
 
-	mac := hmac.New(sha1.New, local.mode.Secret)
+	mac := hmac.New(newHash, mode.Secret)
 	mac.Write(buf.Bytes())
 	buf.Write(mac.Sum(nil))
 
@@ -42,15 +115,12 @@ func marshalPacket(local *localNode) (data []byte, err error) {
 	return
 }
 
-func unmarshalPacket(data []byte, modes map[int]*PacketMode) (node *Node, err error) {
-	const modeIdLength = 1
-	const digestLength = 20
-
-	messageLength := len(data) - digestLength
-
-	compressedLength := messageLength - modeIdLength
-	if compressedLength < 1 {
-		err = fmt.Errorf("packet is too short: %d bytes", len(data))
+// unmarshalPacket authenticates and decodes a packet of any supported
+// protocol version.  The version can't be read before the packet has been
+// authenticated, so the layouts are tried in order.
+func unmarshalPacket(data []byte, modes map[int]*PacketMode) (node *Node, version int, err error) {
+	if len(data) < 1+1+sha1.Size {
+		err = fmt.Errorf("%w: packet is too short: %d bytes", errPacketMalformed, len(data))
 		return
 	}
 
@@ -58,35 +128,134 @@ func unmarshalPacket(data []byte, modes map[int]*PacketMode) (node *Node, err er
 
 	mode := modes[modeId]
 	if mode == nil {
-		err = fmt.Errorf("packet has unknown mode: %d", modeId)
+		err = fmt.Errorf("%w: packet has unknown mode: %d", errPacketInauthentic, modeId)
 		return
 	}
 
-	message := data[:messageLength]
-	digest := data[messageLength:]
+	var (
+		compressed []byte
+		dict       []byte
+	)
 
-	mac := hmac.New(sha1.New, mode.Secret)
-	mac.Write(message)
-	if !hmac.Equal(mac.Sum(nil), digest) {
-		err = fmt.Errorf("packet is inauthentic (mode %d)", modeId)
+	if message, ok := authenticatePacket(data, sha1.New, sha1.Size, mode); ok {
+		version = 1
+		compressed = message[1:]
+		dict = PacketCompressionDict
+	} else if message, ok := authenticatePacket(data, sha256.New, sha256.Size, mode); ok && len(message) >= 3 {
+		version = int(message[1])
+		compressed = message[2:]
+		dict = PacketCompressionDictV2
+
+		if version < 2 || version > maxProtocolVersion {
+			err = fmt.Errorf("%w: unsupported protocol version: %d", errPacketMalformed, version)
+			return
+		}
+	} else {
+		err = fmt.Errorf("%w (mode %d)", errPacketInauthentic, modeId)
 		return
 	}
 
-	compressed := data[modeIdLength:messageLength]
-
-	deflater := flate.NewReaderDict(bytes.NewBuffer(compressed), PacketCompressionDict)
+	deflater := flate.NewReaderDict(bytes.NewBuffer(compressed), dict)
 	defer deflater.Close()
 
+	message, err := ioutil.ReadAll(io.LimitReader(deflater, maxDecompressedSize+1))
+	if err != nil {
+		err = fmt.Errorf("%w: %s", errPacketMalformed, err)
+		return
+	}
+	if len(message) > maxDecompressedSize {
+		err = fmt.Errorf("%w: decompressed packet is larger than %d bytes", errPacketOversized, maxDecompressedSize)
+		return
+	}
+
 	node = new(Node)
-	err = json.NewDecoder(deflater).Decode(node)
+	if err = json.Unmarshal(message, node); err != nil {
+		node = nil
+		err = fmt.Errorf("%w: %s", errPacketMalformed, err)
+		return
+	}
+
+	if err = checkNodeLimits(node); err != nil {
+		node = nil
+		return
+	}
+
+	for _, relayed := range node.Relayed {
+		if err = checkNodeLimits(relayed); err != nil {
+			node = nil
+			return
+		}
+	}
+	return
+}
+
+// authenticatePacket returns the message without the digest, if it's valid.
+func authenticatePacket(data []byte, newHash func() hash.Hash, digestLength int, mode *PacketMode) (message []byte, ok bool) {
+	messageLength := len(data) - digestLength
+	if messageLength < 2 {
+		return
+	}
+
+	message = data[:messageLength]
+
+	mac := hmac.New(newHash, mode.Secret)
+	mac.Write(message)
+	ok = hmac.Equal(mac.Sum(nil), data[messageLength:])
+	return
+}
+
+func checkNodeLimits(node *Node) (err error) {
+	switch {
+	case len(node.Features) > maxNodeFeatures:
+		err = fmt.Errorf("%w: %d features", errPacketOversized, len(node.Features))
+
+	case len(node.Addrs) > maxNodeAddrs:
+		err = fmt.Errorf("%w: %d addresses", errPacketOversized, len(node.Addrs))
+
+	case len(node.Labels) > maxNodeLabels:
+		err = fmt.Errorf("%w: %d labels", errPacketOversized, len(node.Labels))
+
+	case !labelsFit(node.Labels):
+		err = fmt.Errorf("%w: label is too long", errPacketOversized)
+
+	case node.Id != "" && !validNodeId(node.Id):
+		err = fmt.Errorf("bad node id: %q", node.Id)
+
+	case len(node.Relayed) > gossipMaxRelayed:
+		err = fmt.Errorf("%w: %d relayed states", errPacketOversized, len(node.Relayed))
+
+	case node.Probe != nil && len(node.Probe.Failed) > probeMaxFailures:
+		err = fmt.Errorf("%w: %d failure reports", errPacketOversized, len(node.Probe.Failed))
+	}
 	return
 }
 
+// verifyPacketOrigin checks that the packet was sent from one of the node's
+// addresses, and canonicalizes them.  Only a mismatch is reported as
+// errPacketOrigin; bad addresses are malformed.
 func verifyPacketOrigin(node *Node, addr *net.UDPAddr) (err error) {
-	if ip := net.ParseIP(node.IPAddr); ip == nil {
-		err = fmt.Errorf("bad packet address: %s", node.IPAddr)
-	} else if !ip.Equal(addr.IP) {
-		err = fmt.Errorf("packet address %s doesn't match origin %s", node.IPAddr, addr.IP)
+	match := false
+
+	for i, s := range node.ipAddrs() {
+		ip, _, parseErr := parseIPAddr(s)
+		if parseErr != nil {
+			err = fmt.Errorf("%w: bad address: %s", errPacketMalformed, s)
+			return
+		}
+
+		if i == 0 {
+			node.IPAddr = ip.String()
+		} else {
+			node.Addrs[i-1] = ip.String()
+		}
+
+		if ip.Equal(addr.IP) {
+			match = true
+		}
+	}
+
+	if !match {
+		err = fmt.Errorf("%w: %s is not %s", errPacketOrigin, addr.IP, node.IPAddr)
 	}
 	return
 }
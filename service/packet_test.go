@@ -0,0 +1,186 @@
+package service
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Golden packets pin the wire format of each protocol version.  If encoding
+// changes, a new protocol version is needed.
+var goldenPackets = map[int]string{
+	1: "0142d66c68a0078286c8a6189a1aa0031da5e2d4426c32863a4a0545f925f9f1b999794a56085e6285929511aa034a528b4b94ac4a8a4a536b6bb900030056c4ab82f5280e0fa7a4a9ecc568c661bf1ebd40",
+	2: "0102427688a1811e081a2a21596e686a800ea0eec1943124de8925a9c5254a562545a5a9b5b55c800100e3ed9041ba126e6168cf5cbde108a4c9f8596a8554efc4f57eabe8094b08a7b9",
+	3: "0103427688a1811e081a2a21596e686a800ea0eec1943124de8925a9c5254a562545a5a9b5b55c800100d6786d43fff4842196cc31a6082ac56cf8837ade6b31be80b158de11c6d7d02d",
+	4: "0104427688a1811e081a2a21596e686a800ea0eec1943124de8925a9c5254a562545a5a9b5b55c800100304e63a338e87558b22ff05519bc4301811609c3ac431d5024b6a9237e7eca51",
+}
+
+var goldenMode = &PacketMode{
+	Id:     1,
+	Secret: []byte("swordfish"),
+}
+
+func goldenNode() *Node {
+	value := json.RawMessage("true")
+
+	return &Node{
+		IPAddr:   "10.0.0.1",
+		TimeNs:   1500000000000000000,
+		Seq:      1500000000000000001,
+		ProtoMin: 1,
+		ProtoMax: 2,
+		Features: map[string]*json.RawMessage{"test": &value},
+	}
+}
+
+func TestGoldenPackets(t *testing.T) {
+	modes := map[int]*PacketMode{
+		goldenMode.Id: goldenMode,
+	}
+
+	for version := minProtocolVersion; version <= maxProtocolVersion; version++ {
+		golden, found := goldenPackets[version]
+		if !found {
+			t.Errorf("version %d: no golden packet", version)
+			continue
+		}
+
+		data, err := encodePacket(goldenNode(), goldenMode, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hex.EncodeToString(data) != golden {
+			t.Errorf("version %d: encoding changed: %x", version, data)
+		}
+
+		goldenData, _ := hex.DecodeString(golden)
+
+		node, decodedVersion, err := unmarshalPacket(goldenData, modes)
+		if err != nil {
+			t.Errorf("version %d: %s", version, err)
+			continue
+		}
+
+		if decodedVersion != version {
+			t.Errorf("version %d: decoded as version %d", version, decodedVersion)
+		}
+
+		if !reflect.DeepEqual(node, goldenNode()) {
+			t.Errorf("version %d: decoded %#v", version, node)
+		}
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	data, err := encodePacket(goldenNode(), goldenMode, maxProtocolVersion+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modes := map[int]*PacketMode{
+		goldenMode.Id: goldenMode,
+	}
+
+	if _, _, err := unmarshalPacket(data, modes); err == nil {
+		t.Error("unsupported version accepted")
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	for _, c := range []struct {
+		min, max int
+		expect   int
+	}{
+		{0, 0, 1},
+		{1, 1, 1},
+		{1, 2, 2},
+		{2, 2, 2},
+		{1, 99, maxProtocolVersion},
+		{99, 99, 0},
+	} {
+		if version := negotiateVersion(&Node{ProtoMin: c.min, ProtoMax: c.max}); version != c.expect {
+			t.Errorf("%d-%d: %d", c.min, c.max, version)
+		}
+	}
+}
+
+// Golden storage documents pin the S3 format.
+var goldenDocuments = []string{
+	// Before storage versioning.
+	`{
+	"features": {
+		"test": true
+	}
+}
+`,
+	// Version 1.
+	`{
+	"version": 1,
+	"seq": 1500000000000000001,
+	"proto_min": 1,
+	"proto_max": 2,
+	"features": {
+		"test": true
+	}
+}
+`,
+}
+
+func TestGoldenDocuments(t *testing.T) {
+	for i, doc := range goldenDocuments {
+		node := new(Node)
+
+		if err := json.Unmarshal([]byte(doc), node); err != nil {
+			t.Errorf("document %d: %s", i, err)
+			continue
+		}
+
+		if node.Version > storageVersion || node.Features["test"] == nil {
+			t.Errorf("document %d: %#v", i, node)
+		}
+	}
+
+	node := goldenNode()
+	node.Version = storageVersion
+	node.IPAddr = ""
+	node.TimeNs = 0
+
+	data, err := json.MarshalIndent(node, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, '\n')
+
+	if !bytes.Equal(data, []byte(goldenDocuments[len(goldenDocuments)-1])) {
+		t.Errorf("encoding changed: %s", data)
+	}
+}
+
+// Golden signed state pins the signature payload.  It was sent by a newer
+// version which knows about a field that this version doesn't.
+const goldenSignedState = `{"id":"golden","ip_addr":"10.0.0.1","time_ns":1500000000000000000,"seq":1500000000000000001,"proto_min":1,"proto_max":2,"features":{"test":true},"labels":{"zone":"a"},"future":{"x":1},"key":"iojj3XQJ8ZX9UtstPLpdcspnCb8dlBIb83SIAbQPb1w=","sig":"q8eARIlkl866AOsvjbhjcZmaGgT6mBC9XaHnscSVUfl6eYhLTg1X7uOI6zi4Ova1uWK+Fr6ZAKpHMs7VugFgBA=="}`
+
+func TestGoldenSignature(t *testing.T) {
+	received := new(Node)
+
+	if err := json.Unmarshal([]byte(goldenSignedState), received); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyNodeSignature(received); err != nil {
+		t.Error(err)
+	}
+
+	node := goldenNode()
+	node.Id = "golden"
+	node.Labels = map[string]string{"zone": "a"}
+	signNode(node, ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize)))
+
+	if !bytes.Equal(node.Sig, received.Sig) {
+		t.Errorf("signature changed: %x", node.Sig)
+	}
+}
@@ -0,0 +1,401 @@
+package service
+
+import (
+	"context"
+	"math/bits"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// probeProtocolVersion is the lowest protocol version which supports
+	// probes.  Other nodes are not probed.
+	probeProtocolVersion = 3
+
+	probeInterval = time.Second
+
+	// probeTimeout is the time to wait for a direct acknowledgement before
+	// asking other nodes to probe the target.
+	probeTimeout = probeInterval / 3
+
+	// probeIndirect is the number of nodes asked to probe an unresponsive
+	// target.
+	probeIndirect = 3
+
+	// suspectTimeout is the time after which a suspected node is declared
+	// failed, unless it has sent a newer state.
+	suspectTimeout = probeInterval * 5
+
+	// probeMaxFailures limits the number of failure reports per packet.
+	probeMaxFailures = 8
+
+	latencySmoothing = 8
+)
+
+// Probe is a failure detection message.  It is included in a state packet.
+// Ping asks the receiver to acknowledge it; if Target is set, the receiver
+// should ping the target node and forward its acknowledgement.  Ack
+// acknowledges a ping; Target is set if it was forwarded.  Failed reports the
+// latest sequence numbers of nodes which have been declared failed.  Change
+// asks the receiver to confirm the state, and Confirm carries the sequence
+// number of a confirmed state.
+type Probe struct {
+	Ping    uint64           `json:"ping,omitempty"`
+	Ack     uint64           `json:"ack,omitempty"`
+	Target  string           `json:"target,omitempty"`
+	Failed  map[string]int64 `json:"failed,omitempty"`
+	Change  bool             `json:"change,omitempty"`
+	Confirm int64            `json:"confirm,omitempty"`
+}
+
+type pendingProbe struct {
+	target   string
+	deadline time.Time
+
+	// acked is signaled when an acknowledgement is received for our own
+	// probe.
+	acked chan struct{}
+
+	// requester is set when we are probing on behalf of another node.
+	requester   *peerAddr
+	requesterId uint64
+}
+
+type failureReport struct {
+	seq    int64
+	remain int
+}
+
+// prober implements SWIM-style failure detection.  Members are pinged in
+// random round-robin order.  If a member doesn't acknowledge, a few other
+// members are asked to ping it.  If that doesn't help either, the member is
+// suspected, and eventually declared failed unless it sends a newer state.
+// Failures are disseminated by piggybacking them on probes.
+type prober struct {
+	local   *localNode
+	remotes *remoteNodes
+	notify  chan<- struct{}
+	refute  chan<- struct{}
+	log     *Log
+
+	lock     sync.Mutex
+	lastId   uint64
+	pending  map[uint64]*pendingProbe
+	failures map[string]*failureReport
+	order    []string
+}
+
+func newProber(local *localNode, remotes *remoteNodes, notifyState, wakeTransmit chan<- struct{}, log *Log) *prober {
+	return &prober{
+		local:    local,
+		remotes:  remotes,
+		notify:   notifyState,
+		refute:   wakeTransmit,
+		log:      log,
+		pending:  make(map[uint64]*pendingProbe),
+		failures: make(map[string]*failureReport),
+	}
+}
+
+func probeLoop(ctx context.Context, p *prober) {
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if failed := p.remotes.failSuspects(time.Now().Add(-suspectTimeout), p.log); len(failed) > 0 {
+			p.reportFailures(failed)
+			p.notifyState()
+		}
+
+		if ipAddr := p.next(); ipAddr != "" {
+			p.probe(ctx, ipAddr)
+		}
+	}
+}
+
+// next picks the next target.  The member list is shuffled after each pass.
+func (p *prober) next() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for refilled := false; ; {
+		if len(p.order) == 0 {
+			if refilled {
+				return ""
+			}
+			refilled = true
+
+			p.order = p.remotes.probeable()
+			if len(p.order) == 0 {
+				return ""
+			}
+
+			rand.Shuffle(len(p.order), func(i, j int) {
+				p.order[i], p.order[j] = p.order[j], p.order[i]
+			})
+		}
+
+		ipAddr := p.order[0]
+		p.order = p.order[1:]
+
+		if p.remotes.probeAddr(ipAddr) != nil {
+			return ipAddr
+		}
+	}
+}
+
+// probe pings the target directly, and then indirectly.  The target is
+// suspected if there is no acknowledgement by the end of the probe interval.
+func (p *prober) probe(ctx context.Context, target string) (ok bool) {
+	addr := p.remotes.probeAddr(target)
+	if addr == nil {
+		return true
+	}
+
+	deadline := time.Now().Add(probeInterval)
+	id, acked := p.expect(target, deadline)
+	defer p.forget(id)
+
+	sent := time.Now()
+	p.send(addr, &Probe{Ping: id})
+
+	select {
+	case <-acked:
+		p.remotes.observeLatency(target, time.Since(sent))
+		return true
+
+	case <-time.After(probeTimeout):
+
+	case <-ctx.Done():
+		return true
+	}
+
+	p.log.Debugf("%s didn't acknowledge ping; probing indirectly", target)
+
+	for _, helper := range p.remotes.probeHelpers(target, probeIndirect) {
+		p.send(helper, &Probe{Ping: id, Target: target})
+	}
+
+	select {
+	case <-acked:
+		return true
+
+	case <-time.After(time.Until(deadline)):
+
+	case <-ctx.Done():
+		return true
+	}
+
+	p.remotes.suspect(target, time.Now(), p.log)
+	return false
+}
+
+func (p *prober) expect(target string, deadline time.Time) (id uint64, acked chan struct{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.lastId++
+	id = p.lastId
+	acked = make(chan struct{}, 1)
+
+	p.pending[id] = &pendingProbe{
+		target:   target,
+		deadline: deadline,
+		acked:    acked,
+	}
+	return
+}
+
+func (p *prober) forget(id uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.pending, id)
+}
+
+// handle processes the probe of a packet sent by node.  The node's state
+// has already been updated.
+func (p *prober) handle(node *Node, probe *Probe) {
+	if len(probe.Failed) > 0 {
+		p.receiveFailures(node, probe.Failed)
+	}
+
+	if probe.Ack != 0 {
+		p.receiveAck(node, probe)
+	}
+
+	if probe.Ping != 0 {
+		p.receivePing(node, probe)
+	}
+}
+
+func (p *prober) receivePing(node *Node, probe *Probe) {
+	sender := p.remotes.probeAddr(node.IPAddr)
+	if sender == nil {
+		p.log.Debugf("ping from unknown or unprobeable node %s", node.IPAddr)
+		return
+	}
+
+	if probe.Target == "" {
+		p.send(sender, &Probe{Ack: probe.Ping})
+		return
+	}
+
+	addr := p.remotes.probeAddr(probe.Target)
+	if addr == nil {
+		p.log.Debugf("%s asked to probe unknown node %s", node.IPAddr, probe.Target)
+		return
+	}
+
+	p.lock.Lock()
+	p.purge(time.Now())
+	p.lastId++
+	id := p.lastId
+	p.pending[id] = &pendingProbe{
+		target:      probe.Target,
+		deadline:    time.Now().Add(probeInterval),
+		requester:   sender,
+		requesterId: probe.Ping,
+	}
+	p.lock.Unlock()
+
+	p.send(addr, &Probe{Ping: id})
+}
+
+func (p *prober) receiveAck(node *Node, probe *Probe) {
+	target := node.IPAddr
+	if probe.Target != "" {
+		target = probe.Target
+	}
+
+	p.lock.Lock()
+	pending := p.pending[probe.Ack]
+	if pending != nil && pending.target == target && pending.requester != nil {
+		delete(p.pending, probe.Ack)
+	}
+	p.lock.Unlock()
+
+	switch {
+	case pending == nil || pending.target != target:
+		p.log.Debugf("unexpected acknowledgement from %s", node.IPAddr)
+
+	case pending.requester != nil:
+		p.send(pending.requester, &Probe{Ack: pending.requesterId, Target: target})
+
+	default:
+		select {
+		case pending.acked <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (p *prober) receiveFailures(node *Node, failed map[string]int64) {
+	var reported map[string]int64
+
+	for ipAddr, seq := range failed {
+		if ipAddr == p.local.ipAddr {
+			p.log.Infof("%s reported us as failed; refuting", node.IPAddr)
+
+			select {
+			case p.refute <- struct{}{}:
+			default:
+			}
+			continue
+		}
+
+		if p.remotes.fail(ipAddr, seq, time.Now(), p.log) {
+			if reported == nil {
+				reported = make(map[string]int64)
+			}
+			reported[ipAddr] = seq
+		}
+	}
+
+	if reported != nil {
+		p.reportFailures(reported)
+		p.notifyState()
+	}
+}
+
+// reportFailures queues failures for dissemination.  Each failure is
+// piggybacked on a logarithmic number of probes.
+func (p *prober) reportFailures(failed map[string]int64) {
+	remain := disseminationCount(len(p.remotes.probeable()) + 1)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for ipAddr, seq := range failed {
+		p.failures[ipAddr] = &failureReport{
+			seq:    seq,
+			remain: remain,
+		}
+	}
+}
+
+// smoothLatency updates a round-trip time estimate with a new sample.
+func smoothLatency(latency, sample time.Duration, first bool) time.Duration {
+	if first {
+		return sample
+	}
+
+	return latency + (sample-latency)/latencySmoothing
+}
+
+func disseminationCount(members int) int {
+	return 3 * bits.Len(uint(members))
+}
+
+// send includes queued failure reports in the probe.
+func (p *prober) send(addr *peerAddr, probe *Probe) {
+	p.lock.Lock()
+	for ipAddr, report := range p.failures {
+		if len(probe.Failed) >= probeMaxFailures {
+			break
+		}
+
+		if probe.Failed == nil {
+			probe.Failed = make(map[string]int64)
+		}
+		probe.Failed[ipAddr] = report.seq
+
+		if report.remain--; report.remain <= 0 {
+			delete(p.failures, ipAddr)
+		}
+	}
+	p.lock.Unlock()
+
+	data, err := marshalPacket(p.local, nil, probe, addr.version)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := p.local.send(data, addr); err != nil {
+		p.log.Error(err)
+	}
+}
+
+// purge forgets indirect probes which have timed out.  Caller must hold the
+// lock.
+func (p *prober) purge(now time.Time) {
+	for id, pending := range p.pending {
+		if pending.requester != nil && now.After(pending.deadline) {
+			delete(p.pending, id)
+		}
+	}
+}
+
+func (p *prober) notifyState() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type testMember struct {
+	local     *localNode
+	remotes   *remoteNodes
+	prober    *prober
+	confirmer *confirmer
+	refute    chan struct{}
+}
+
+func newTestMember(t *testing.T, ipAddr string) *testMember {
+	m := &testMember{
+		local:   newTestLocalNode(t, ipAddr),
+		remotes: newRemoteNodes(0),
+		refute:  make(chan struct{}, 1),
+	}
+
+	m.prober = newProber(m.local, m.remotes, make(chan struct{}, 1), m.refute, &testLog)
+	m.confirmer = newConfirmer(m.local, m.remotes, &testLog)
+
+	r := &receiver{
+		local:   m.local,
+		remotes: m.remotes,
+		modes: map[int]*PacketMode{
+			testMode.Id: testMode,
+		},
+		prober:    m.prober,
+		confirmer: m.confirmer,
+		stats:     new(Stats),
+		notify:    make(chan struct{}, 1),
+		reply:     make(chan []*peerAddr, 100),
+		log:       &testLog,
+	}
+	r.listen()
+
+	return m
+}
+
+// know makes m aware of other, as if it had been loaded from S3.
+func (m *testMember) know(other *testMember) {
+	m.remotes.update(other.local.packetNode(nil), sourceStorage, nil, time.Now(), m.local, &testLog)
+}
+
+func TestProbe(t *testing.T) {
+	ctx := context.Background()
+
+	a := newTestMember(t, "127.0.0.4")
+	defer closeTestLocalNode(a.local)
+
+	b := newTestMember(t, "127.0.0.2")
+	defer closeTestLocalNode(b.local)
+
+	c := newTestMember(t, "127.0.0.3")
+	defer closeTestLocalNode(c.local)
+
+	a.know(b)
+	b.know(a)
+	b.know(c)
+	c.know(b)
+
+	if !a.prober.probe(ctx, "127.0.0.2") {
+		t.Error("direct probe failed")
+	}
+
+	status := a.remotes.statuses()["127.0.0.2"]
+	if status.LatencyNs <= 0 || status.Source != "packet" || status.Transport != "udp" || status.ProtocolVersion != maxProtocolVersion {
+		t.Errorf("%#v", status)
+	}
+
+	// a knows a wrong port for c, so it has to go through b.
+	stale := c.local.packetNode(nil)
+	stale.Port = freeTestPort(t)
+	a.remotes.update(stale, sourceStorage, nil, time.Now(), a.local, &testLog)
+
+	if !a.prober.probe(ctx, "127.0.0.3") {
+		t.Error("indirect probe failed")
+	}
+
+	closeTestLocalNode(c.local)
+
+	if b.prober.probe(ctx, "127.0.0.3") {
+		t.Fatal("closed node acknowledged")
+	}
+
+	failed := b.remotes.failSuspects(time.Now().Add(time.Second), &testLog)
+	if _, found := failed["127.0.0.3"]; !found || b.remotes.probeAddr("127.0.0.3") != nil {
+		t.Fatal(failed)
+	}
+
+	b.remotes.update(stale, sourceStorage, nil, time.Now(), b.local, &testLog)
+	if b.remotes.probeAddr("127.0.0.3") != nil {
+		t.Error("failed node resurrected by outdated state")
+	}
+
+	// The failure is disseminated with the next probe.
+	b.prober.reportFailures(failed)
+
+	if !b.prober.probe(ctx, "127.0.0.4") {
+		t.Error("probe failed")
+	}
+
+	if a.remotes.probeAddr("127.0.0.3") != nil {
+		t.Error("failure was not disseminated")
+	}
+
+	// A live node refutes a failure report.
+	b.prober.reportFailures(map[string]int64{"127.0.0.4": 1})
+	b.prober.probe(ctx, "127.0.0.4")
+
+	select {
+	case <-a.refute:
+	case <-time.After(time.Second * 5):
+		t.Error("failure report was not refuted")
+	}
+}
+
+func TestDisseminationCount(t *testing.T) {
+	for members, expect := range map[int]int{1: 3, 2: 6, 1000: 30} {
+		if n := disseminationCount(members); n != expect {
+			t.Errorf("%d members: %d", members, n)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+)
+
+// Snapshot is a JSON-compatible representation of the whole cluster, written
+// to a single file in the state directory.  Generation is incremented whenever
+// the content changes, also across restarts.  Hosts are named like in the
+// feature tree, so the local host is 127.0.0.1.
+type Snapshot struct {
+	Generation int64                    `json:"generation"`
+	Hosts      map[string]*SnapshotHost `json:"hosts"`
+}
+
+// SnapshotHost contains the features of a host, and the parts of its status
+// which don't change without the host changing.  Features of hidden hosts are
+// omitted.
+type SnapshotHost struct {
+	IPAddr     string                      `json:"ip_addr"`
+	Id         string                      `json:"id,omitempty"`
+	Labels     map[string]string           `json:"labels,omitempty"`
+	Membership Membership                  `json:"membership"`
+	Damped     bool                        `json:"damped,omitempty"`
+	Features   map[string]*json.RawMessage `json:"features,omitempty"`
+}
+
+// snapshotWriter replaces the snapshot file when its content has changed.
+type snapshotWriter struct {
+	filename   string
+	tmpDir     string
+	log        *Log
+	generation int64
+	hosts      []byte // Previously written content.
+}
+
+// newSnapshotWriter continues from the generation of an existing file.
+func newSnapshotWriter(filename, tmpDir string, log *Log) *snapshotWriter {
+	s := &snapshotWriter{
+		filename: filename,
+		tmpDir:   tmpDir,
+		log:      log,
+	}
+
+	if data, err := ioutil.ReadFile(filename); err == nil {
+		old := new(Snapshot)
+		if err := json.Unmarshal(data, old); err != nil {
+			log.Errorf("%s: %s", filename, err)
+		}
+		s.generation = old.Generation
+	}
+
+	return s
+}
+
+// snapshotHosts describes the current state of all hosts.  A new map is
+// created each time, and it's not modified afterwards.
+func snapshotHosts(local *localNode, view *remoteView, layout StateLayout) (hosts map[string]*SnapshotHost) {
+	hosts = make(map[string]*SnapshotHost)
+
+	hosts[loopbackIPAddr] = &SnapshotHost{
+		IPAddr:     local.ipAddr,
+		Id:         local.id,
+		Labels:     local.labels,
+		Membership: MemberAlive,
+		Features:   local.getNode().Features,
+	}
+
+	for _, status := range view.statuses {
+		hosts[layout.name(status.IPAddr, status.Id)] = &SnapshotHost{
+			IPAddr:     status.IPAddr,
+			Id:         status.Id,
+			Labels:     status.Labels,
+			Membership: status.Membership,
+			Damped:     status.Damped,
+		}
+	}
+
+	for _, node := range view.nodes {
+		if host := hosts[layout.name(node.IPAddr, node.Id)]; host != nil {
+			host.Features = node.Features
+		}
+	}
+
+	return
+}
+
+func (s *snapshotWriter) write(hosts map[string]*SnapshotHost) {
+	data, err := json.Marshal(hosts)
+	if err != nil {
+		panic(err)
+	}
+
+	if bytes.Equal(data, s.hosts) {
+		return
+	}
+
+	snapshot := &Snapshot{
+		Generation: s.generation + 1,
+		Hosts:      hosts,
+	}
+
+	output, err := json.MarshalIndent(snapshot, "", "\t")
+	if err != nil {
+		panic(err)
+	}
+	output = append(output, byte('\n'))
+
+	s.log.Debugf("writing snapshot generation %d", snapshot.Generation)
+
+	if writeStateFile(s.filename, output, s.tmpDir, s.log) {
+		s.generation = snapshot.Generation
+		s.hosts = data
+	}
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nameq-service-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := newTestLocalNode(t, "127.0.0.1")
+	defer closeTestLocalNode(local)
+
+	filename := filepath.Join(dir, "snapshot.json")
+	value := json.RawMessage("true")
+	remotes := newRemoteNodes(0)
+
+	read := func() *Snapshot {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		snapshot := new(Snapshot)
+		if err := json.Unmarshal(data, snapshot); err != nil {
+			t.Fatal(err)
+		}
+		return snapshot
+	}
+
+	s := newSnapshotWriter(filename, dir, &testLog)
+	s.write(snapshotHosts(local, remotes.view(), LayoutIP))
+
+	if snapshot := read(); snapshot.Generation != 1 || len(snapshot.Hosts) != 1 || snapshot.Hosts["127.0.0.1"] == nil {
+		t.Errorf("initial: %#v", snapshot)
+	}
+
+	remotes.update(&Node{IPAddr: "10.0.0.1", Seq: 1, Features: map[string]*json.RawMessage{"test": &value}}, sourcePacket, nil, time.Now(), local, &testLog)
+	s.write(snapshotHosts(local, remotes.view(), LayoutIP))
+	s.write(snapshotHosts(local, remotes.view(), LayoutIP))
+
+	snapshot := read()
+	if snapshot.Generation != 2 {
+		t.Errorf("generation: %d", snapshot.Generation)
+	}
+
+	if host := snapshot.Hosts["10.0.0.1"]; host == nil || host.Membership != MemberAlive || host.Features["test"] == nil {
+		t.Errorf("host: %#v", host)
+	}
+
+	remotes.update(&Node{IPAddr: "10.0.0.1", Seq: 2, Leaving: true}, sourcePacket, nil, time.Now(), local, &testLog)
+	s.write(snapshotHosts(local, remotes.view(), LayoutIP))
+
+	snapshot = read()
+	if host := snapshot.Hosts["10.0.0.1"]; snapshot.Generation != 3 || host == nil || host.Membership != MemberLeft || host.Features != nil {
+		t.Errorf("left: %d %#v", snapshot.Generation, host)
+	}
+
+	// Generation continues after restart.
+	s = newSnapshotWriter(filename, dir, &testLog)
+	s.write(snapshotHosts(local, remotes.view(), LayoutIP))
+
+	if snapshot := read(); snapshot.Generation != 4 {
+		t.Errorf("restart: %d", snapshot.Generation)
+	}
+}
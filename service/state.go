@@ -10,43 +10,260 @@ import (
 
 const (
 	loopbackIPAddr = "127.0.0.1"
+	hostFileSuffix = ".json"
 )
 
-func initState(local *localNode, remotes *remoteNodes, stateDir string, notifyState <-chan struct{}, log *Log) (err error) {
-	featureDir := filepath.Join(stateDir, "features")
-	tmpDir := filepath.Join(stateDir, ".tmp")
+// NodeStatus is a JSON-compatible representation of what the local node knows
+// about a remote host.  It is written to the state directory.  IPAddr is the
+// primary address of the host, and Id its node id if it has one.  LastSeenNs is
+// the local time when the host's state was last received, or the S3
+// modification time.  Source tells where the current state came from
+// ("packet", "s3" or "gossip").  Transport and ProtocolVersion are used when
+// sending to the host, and LatencyNs is the smoothed round-trip time of
+// probes.  Damped is set while the host's features are hidden because it has
+// been flapping.
+type NodeStatus struct {
+	IPAddr            string            `json:"ip_addr"`
+	Id                string            `json:"id,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Membership        Membership        `json:"membership"`
+	MembershipSinceNs int64             `json:"membership_since_ns"`
+	LastSeenNs        int64             `json:"last_seen_ns"`
+	Source            string            `json:"source"`
+	Transport         string            `json:"transport,omitempty"`
+	ProtocolVersion   int               `json:"protocol_version,omitempty"`
+	LatencyNs         int64             `json:"latency_ns,omitempty"`
+	ClockOffsetNs     int64             `json:"clock_offset_ns"`
+	ClockSkewed       bool              `json:"clock_skewed,omitempty"`
+	FlapPenalty       float64           `json:"flap_penalty,omitempty"`
+	Damped            bool              `json:"damped,omitempty"`
+}
 
-	if err = os.MkdirAll(featureDir, 0755); err != nil {
-		return
+// stateTree locates the parts of the state directory.  hostDir is empty unless
+// the host view is enabled.
+type stateTree struct {
+	featureDir string
+	nodeDir    string
+	labelDir   string
+	hostDir    string
+	snapshot   string
+	hostsFile  string
+	tmpDir     string
+}
+
+func newStateTree(stateDir string, hostView bool) *stateTree {
+	tree := &stateTree{
+		featureDir: filepath.Join(stateDir, "features"),
+		nodeDir:    filepath.Join(stateDir, "nodes"),
+		labelDir:   filepath.Join(stateDir, "labels"),
+		snapshot:   filepath.Join(stateDir, "snapshot.json"),
+		hostsFile:  filepath.Join(stateDir, "hostsfile"),
+		tmpDir:     filepath.Join(stateDir, ".tmp"),
+	}
+
+	if hostView {
+		tree.hostDir = filepath.Join(stateDir, "hosts")
+	}
+
+	return tree
+}
+
+// roots of the files maintained by stateWriter.
+func (tree *stateTree) roots() (dirs []string) {
+	dirs = []string{tree.featureDir, tree.nodeDir, tree.labelDir}
+
+	if tree.hostDir != "" {
+		dirs = append(dirs, tree.hostDir)
+	}
+	return
+}
+
+// initState starts maintaining the state directory.  The hosts file is written
+// if domain is not empty.
+func initState(local *localNode, remotes *remoteNodes, stateDir string, layout StateLayout, hostView bool, domain string, hub *eventHub, notifyState <-chan struct{}, log *Log) (err error) {
+	tree := newStateTree(stateDir, hostView)
+
+	for _, dir := range tree.roots() {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return
+		}
 	}
 
-	if err = os.MkdirAll(tmpDir, 0700); err != nil {
+	if err = os.MkdirAll(tree.tmpDir, 0700); err != nil {
 		return
 	}
 
-	go stateLoop(local, remotes, featureDir, tmpDir, notifyState, log)
+	if !hostView {
+		// Don't leave a stale view behind if it was enabled previously.
+		if err = os.RemoveAll(filepath.Join(stateDir, "hosts")); err != nil {
+			return
+		}
+	}
+
+	var hf *hostsFileWriter
+
+	if domain != "" {
+		hf = newHostsFileWriter(tree.hostsFile, tree.tmpDir, domain, log)
+	} else {
+		os.Remove(tree.hostsFile) // Stale if it was enabled previously.
+	}
+
+	go stateLoop(local, remotes, layout, tree, hf, hub, notifyState, log)
 
 	return
 }
 
-func stateLoop(local *localNode, remotes *remoteNodes, featureDir, tmpDir string, notifyState <-chan struct{}, log *Log) {
+// stateLoop writes node states and labels before feature states, so that node
+// ids and labels of hosts found in the feature directory can be resolved.  The
+// snapshot and the hosts file (if any) are written last, and then the event hub
+// is updated (if any).  They are all based on the same view of the remote
+// nodes.
+func stateLoop(local *localNode, remotes *remoteNodes, layout StateLayout, tree *stateTree, hf *hostsFileWriter, hub *eventHub, notifyState <-chan struct{}, log *Log) {
+	w := newStateWriter(tree.tmpDir, log, tree.roots()...)
+	s := newSnapshotWriter(tree.snapshot, tree.tmpDir, log)
+
 	for range notifyState {
-		filenames := make(map[string]struct{})
+		view := remotes.view()
 
-		writeFeatureState(loopbackIPAddr, local.getNode(), featureDir, tmpDir, filenames, log)
+		writeState(w, local, view, layout, tree)
 
-		for _, node := range remotes.nodes() {
-			writeFeatureState(node.IPAddr, node, featureDir, tmpDir, filenames, log)
+		hosts := snapshotHosts(local, view, layout)
+		s.write(hosts)
+
+		if hf != nil {
+			hf.write(local, view)
+		}
+
+		if hub != nil {
+			hub.update(hosts)
 		}
+	}
+}
+
+func writeState(w *stateWriter, local *localNode, view *remoteView, layout StateLayout, tree *stateTree) {
+	w.begin()
+
+	for _, status := range view.statuses {
+		w.write(filepath.Join(tree.nodeDir, layout.name(status.IPAddr, status.Id)), status)
+	}
 
-		err := filepath.Walk(featureDir, func(path string, info os.FileInfo, err error) error {
+	nodes := view.nodes
+
+	w.group(filepath.Join(tree.labelDir, loopbackIPAddr), local, func() {
+		writeLabelState(w, loopbackIPAddr, local.labels, tree.labelDir)
+	})
+
+	for _, node := range nodes {
+		name := layout.name(node.IPAddr, node.Id)
+
+		w.group(filepath.Join(tree.labelDir, name), node, func() {
+			writeLabelState(w, name, node.Labels, tree.labelDir)
+		})
+	}
+
+	localNode := local.getNode()
+
+	w.group(filepath.Join(tree.featureDir, loopbackIPAddr), localNode, func() {
+		writeFeatureState(w, loopbackIPAddr, localNode, tree.featureDir)
+	})
+
+	for _, node := range nodes {
+		name := layout.name(node.IPAddr, node.Id)
+
+		w.group(filepath.Join(tree.featureDir, name), node, func() {
+			writeFeatureState(w, name, node, tree.featureDir)
+		})
+	}
+
+	if tree.hostDir != "" {
+		w.group(filepath.Join(tree.hostDir, loopbackIPAddr), localNode, func() {
+			writeHostState(w, loopbackIPAddr, localNode, tree.hostDir)
+		})
+
+		for _, node := range nodes {
+			name := layout.name(node.IPAddr, node.Id)
+
+			w.group(filepath.Join(tree.hostDir, name), node, func() {
+				writeHostState(w, name, node, tree.hostDir)
+			})
+		}
+	}
+
+	w.finish()
+}
+
+func writeFeatureState(w *stateWriter, name string, node *Node, featureDir string) {
+	for feature, value := range node.Features {
+		w.write(filepath.Join(featureDir, feature, name), &value)
+	}
+}
+
+// writeHostState writes all features of a host into a single file, and then
+// each of them into a directory named after the host.
+func writeHostState(w *stateWriter, name string, node *Node, hostDir string) {
+	if len(node.Features) == 0 {
+		return
+	}
+
+	w.write(filepath.Join(hostDir, name+hostFileSuffix), node.Features)
+
+	for feature, value := range node.Features {
+		w.write(filepath.Join(hostDir, name, feature), &value)
+	}
+}
+
+func writeLabelState(w *stateWriter, name string, labels map[string]string, labelDir string) {
+	if len(labels) > 0 {
+		w.write(filepath.Join(labelDir, name), labels)
+	}
+}
+
+// stateWriter remembers the files it has written, so that only changed files
+// are touched.  Files are written in groups which are derived from a source
+// state; a group is skipped if its source hasn't been replaced since the
+// previous round.  Files which are not written during a round are removed,
+// along with the directories which become empty.
+type stateWriter struct {
+	tmpDir string
+	log    *Log
+	roots  map[string]struct{}
+
+	files   map[string][]byte      // Contents of written files.
+	groups  map[string]*stateGroup // Groups of the previous round.
+	current map[string]struct{}    // Files of the current round.
+	visited map[string]struct{}    // Groups of the current round.
+	writing *stateGroup
+}
+
+type stateGroup struct {
+	source interface{}
+	files  []string
+	failed bool
+}
+
+// newStateWriter takes over the files which already exist in the root
+// directories.
+func newStateWriter(tmpDir string, log *Log, roots ...string) *stateWriter {
+	w := &stateWriter{
+		tmpDir: tmpDir,
+		log:    log,
+		roots:  make(map[string]struct{}),
+		files:  make(map[string][]byte),
+		groups: make(map[string]*stateGroup),
+	}
+
+	for _, root := range roots {
+		w.roots[root] = struct{}{}
+
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				log.Errorf("%s: %s", path, err)
 			} else if !info.IsDir() {
-				if _, found := filenames[path]; !found {
-					log.Debugf("removing file %s", path)
-					os.Remove(path)
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					log.Error(err)
 				}
+				w.files[path] = data
 			}
 
 			return nil
@@ -55,64 +272,138 @@ func stateLoop(local *localNode, remotes *remoteNodes, featureDir, tmpDir string
 			log.Error(err)
 		}
 	}
+
+	return w
 }
 
-func writeFeatureState(ipAddr string, node *Node, featureDir, tmpDir string, filenames map[string]struct{}, log *Log) {
-	for feature, value := range node.Features {
-		dirname := filepath.Join(featureDir, feature)
-		filename := filepath.Join(dirname, ipAddr)
+func (w *stateWriter) begin() {
+	w.current = make(map[string]struct{})
+	w.visited = make(map[string]struct{})
+}
 
-		filenames[filename] = struct{}{}
+// group writes files using fn, or keeps the files written previously if
+// source is the same.  source must be comparable.
+func (w *stateWriter) group(key string, source interface{}, fn func()) {
+	w.visited[key] = struct{}{}
 
-		newData, err := json.MarshalIndent(&value, "", "\t")
-		if err != nil {
-			panic(err)
+	if g := w.groups[key]; g != nil && g.source == source {
+		for _, filename := range g.files {
+			w.current[filename] = struct{}{}
 		}
-		newData = append(newData, byte('\n'))
+		return
+	}
 
-		if oldData, err := ioutil.ReadFile(filename); err != nil {
-			log.Debugf("creating file %s", filename)
-		} else if bytes.Compare(oldData, newData) != 0 {
-			log.Debugf("updating file %s", filename)
-		} else {
-			continue
-		}
+	w.writing = &stateGroup{source: source}
+	fn()
 
-		file, err := ioutil.TempFile(tmpDir, "feature")
-		if err != nil {
-			log.Error(err)
-			continue
-		}
+	if w.writing.failed {
+		delete(w.groups, key) // Try again next time.
+	} else {
+		w.groups[key] = w.writing
+	}
+	w.writing = nil
+}
 
-		if _, err := file.Write(newData); err != nil {
-			file.Close()
-			os.Remove(file.Name())
-			log.Error(err)
-			continue
-		}
+// write a file, unless its content is already up to date.
+func (w *stateWriter) write(filename string, value interface{}) {
+	w.current[filename] = struct{}{}
 
-		if err := file.Chmod(0444); err != nil {
-			file.Close()
-			os.Remove(file.Name())
-			log.Error(err)
-			continue
+	if w.writing != nil {
+		w.writing.files = append(w.writing.files, filename)
+	}
+
+	data, err := json.MarshalIndent(value, "", "\t")
+	if err != nil {
+		panic(err)
+	}
+	data = append(data, byte('\n'))
+
+	if old, found := w.files[filename]; !found {
+		w.log.Debugf("creating file %s", filename)
+	} else if bytes.Equal(old, data) {
+		return
+	} else {
+		w.log.Debugf("updating file %s", filename)
+	}
+
+	if writeStateFile(filename, data, w.tmpDir, w.log) {
+		w.files[filename] = data
+	} else if w.writing != nil {
+		w.writing.failed = true
+	}
+}
+
+// finish removes the files which were not written during the round.
+func (w *stateWriter) finish() {
+	for key := range w.groups {
+		if _, found := w.visited[key]; !found {
+			delete(w.groups, key)
 		}
+	}
 
-		if err := file.Close(); err != nil {
-			os.Remove(file.Name())
-			log.Error(err)
+	for filename := range w.files {
+		if _, found := w.current[filename]; found {
 			continue
 		}
 
-		if err := os.MkdirAll(dirname, 0755); err != nil {
-			os.Remove(file.Name())
-			log.Error(err)
+		w.log.Debugf("removing file %s", filename)
+
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			w.log.Error(err)
 			continue
 		}
+		delete(w.files, filename)
 
-		if err := os.Rename(file.Name(), filename); err != nil {
-			os.Remove(file.Name())
-			log.Error(err)
+		if dir := filepath.Dir(filename); !w.root(dir) {
+			os.Remove(dir) // Fails unless empty.
 		}
 	}
 }
+
+func (w *stateWriter) root(dir string) bool {
+	_, found := w.roots[dir]
+	return found
+}
+
+// writeStateFile replaces a file atomically.
+func writeStateFile(filename string, data []byte, tmpDir string, log *Log) bool {
+	file, err := ioutil.TempFile(tmpDir, "state")
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		log.Error(err)
+		return false
+	}
+
+	if err := file.Chmod(0444); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		log.Error(err)
+		return false
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		log.Error(err)
+		return false
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		os.Remove(file.Name())
+		log.Error(err)
+		return false
+	}
+
+	if err := os.Rename(file.Name(), filename); err != nil {
+		os.Remove(file.Name())
+		log.Error(err)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nameq-service-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := newTestLocalNode(t, "127.0.0.1")
+	defer closeTestLocalNode(local)
+
+	value := json.RawMessage("true")
+	remotes := newRemoteNodes(0)
+	remotes.update(&Node{IPAddr: "10.0.0.1", Seq: 1, ProtoMax: 2, Features: map[string]*json.RawMessage{"test": &value}, Labels: map[string]string{"zone": "a"}}, sourcePacket, nil, time.Now(), local, &testLog)
+
+	tree := newTestStateTree(t, dir, true)
+
+	notify := make(chan struct{}, 1)
+	notify <- struct{}{}
+	close(notify)
+
+	stateLoop(local, remotes, LayoutIP, tree, nil, nil, notify, &testLog)
+
+	if _, err := os.Stat(filepath.Join(dir, "features", "test", "10.0.0.1")); err != nil {
+		t.Error(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "nodes", "10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := new(NodeStatus)
+	if err := json.Unmarshal(data, status); err != nil {
+		t.Fatal(err)
+	}
+
+	if status.IPAddr != "10.0.0.1" || status.Membership != MemberAlive || status.Source != "packet" || status.LastSeenNs == 0 || status.ProtocolVersion != 2 {
+		t.Errorf("%s", data)
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(dir, "labels", "10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var labels map[string]string
+	if err := json.Unmarshal(data, &labels); err != nil || labels["zone"] != "a" {
+		t.Errorf("%s", data)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "hosts", "10.0.0.1", "test")); err != nil {
+		t.Error(err)
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(dir, "hosts", "10.0.0.1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var features map[string]bool
+	if err := json.Unmarshal(data, &features); err != nil || !features["test"] {
+		t.Errorf("%s", data)
+	}
+
+	if tmp, _ := ioutil.ReadDir(filepath.Join(dir, ".tmp")); len(tmp) != 0 {
+		t.Error("temporary files left behind")
+	}
+}
+
+func newTestStateTree(t testing.TB, dir string, hostView bool) *stateTree {
+	tree := newStateTree(dir, hostView)
+
+	for _, d := range append(tree.roots(), tree.tmpDir) {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return tree
+}
+
+func TestStateWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nameq-service-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := newTestLocalNode(t, "127.0.0.1")
+	defer closeTestLocalNode(local)
+
+	tree := newTestStateTree(t, dir, false)
+	featureDir := tree.featureDir
+
+	// Left behind by a previous run.
+	stale := filepath.Join(featureDir, "stale", "10.0.0.9")
+	os.Mkdir(filepath.Dir(stale), 0700)
+	if err := ioutil.WriteFile(stale, []byte("true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	value := json.RawMessage("true")
+	remotes := newRemoteNodes(0)
+	remotes.update(&Node{IPAddr: "10.0.0.1", Seq: 1, Features: map[string]*json.RawMessage{"test": &value}}, sourcePacket, nil, time.Now(), local, &testLog)
+
+	w := newStateWriter(tree.tmpDir, &testLog, tree.roots()...)
+	writeState(w, local, remotes.view(), LayoutIP, tree)
+
+	exists := func(path ...string) bool {
+		_, err := os.Stat(filepath.Join(append([]string{featureDir}, path...)...))
+		return err == nil
+	}
+
+	if !exists("test", "10.0.0.1") || exists("stale") {
+		t.Error("first round")
+	}
+
+	// Files of unchanged nodes are not touched.
+	filename := filepath.Join(featureDir, "test", "10.0.0.1")
+	os.Chmod(filename, 0644)
+	if err := ioutil.WriteFile(filename, []byte("tampered\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	writeState(w, local, remotes.view(), LayoutIP, tree)
+
+	if data, _ := ioutil.ReadFile(filename); string(data) != "tampered\n" {
+		t.Errorf("unchanged file was rewritten: %s", data)
+	}
+
+	remotes.update(&Node{IPAddr: "10.0.0.1", Seq: 2, Features: map[string]*json.RawMessage{"other": &value}}, sourcePacket, nil, time.Now(), local, &testLog)
+	writeState(w, local, remotes.view(), LayoutIP, tree)
+
+	if !exists("other", "10.0.0.1") || exists("test") {
+		t.Error("emptied feature directory was not removed")
+	}
+}
+
+// BenchmarkStateWriter compares the incremental writer with a full rewrite
+// (which is what a new writer does) in a cluster of 300 nodes with 10
+// features each, when a single node changes.
+func BenchmarkStateWriter(b *testing.B) {
+	dir, err := ioutil.TempDir("", "nameq-service-test-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := &localNode{
+		ipAddr: "127.0.0.1",
+		udp:    new(udpTransport),
+		clock:  new(hybridClock),
+	}
+	local.setNode(new(Node))
+
+	tree := newTestStateTree(b, dir, false)
+
+	value := json.RawMessage(`{"port": 8080, "weight": 100}`)
+	remotes := newRemoteNodes(0)
+	seq := int64(0)
+
+	update := func(i int) {
+		seq++
+		features := make(map[string]*json.RawMessage)
+		for j := 0; j < 10; j++ {
+			features[fmt.Sprintf("feature-%d", j)] = &value
+		}
+		remotes.update(&Node{IPAddr: fmt.Sprintf("10.0.%d.%d", i/250, i%250+1), Seq: seq, Features: features}, sourceStorage, nil, time.Now(), local, &testLog)
+	}
+
+	for i := 0; i < 300; i++ {
+		update(i)
+	}
+
+	w := newStateWriter(tree.tmpDir, &testLog, tree.roots()...)
+	writeState(w, local, remotes.view(), LayoutIP, tree)
+
+	b.Run("full", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			update(n % 300)
+			w := newStateWriter(tree.tmpDir, &testLog, tree.roots()...)
+			writeState(w, local, remotes.view(), LayoutIP, tree)
+		}
+	})
+
+	b.Run("incremental", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			update(n % 300)
+			writeState(w, local, remotes.view(), LayoutIP, tree)
+		}
+	})
+}
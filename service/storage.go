@@ -39,7 +39,7 @@ func randomStorageInterval() time.Duration {
 	return randomDuration(minStorageInterval, maxStorageInterval)
 }
 
-func initStorage(ctx context.Context, local *localNode, remotes *remoteNodes, notify <-chan struct{}, reply chan<- []*net.UDPAddr, done chan<- struct{}, credData []byte, region, bucket, prefix string, dryRun bool, log *Log) (err error) {
+func initStorage(ctx context.Context, local *localNode, remotes *remoteNodes, notify, resync <-chan struct{}, reply chan<- []*peerAddr, done chan<- struct{}, credData []byte, region, bucket, prefix string, dryRun bool, log *Log) (err error) {
 	if prefix != "" && !strings.HasSuffix(prefix, "/") {
 		prefix += "/"
 	}
@@ -60,6 +60,8 @@ func initStorage(ctx context.Context, local *localNode, remotes *remoteNodes, no
 		}))
 	}
 
+	restoreSeq(local, client, bucket, localKey, log)
+
 	if err = updateStorage(local, client, bucket, localKey, log); err != nil {
 		return
 	}
@@ -68,12 +70,12 @@ func initStorage(ctx context.Context, local *localNode, remotes *remoteNodes, no
 		return
 	}
 
-	go storageLoop(ctx, local, remotes, notify, reply, done, client, bucket, prefix, localKey, log)
+	go storageLoop(ctx, local, remotes, notify, resync, reply, done, client, bucket, prefix, localKey, log)
 
 	return
 }
 
-func storageLoop(ctx context.Context, local *localNode, remotes *remoteNodes, notify <-chan struct{}, reply chan<- []*net.UDPAddr, done chan<- struct{}, client *s3.S3, bucket, prefix, localKey string, log *Log) {
+func storageLoop(ctx context.Context, local *localNode, remotes *remoteNodes, notify, resync <-chan struct{}, reply chan<- []*peerAddr, done chan<- struct{}, client *s3.S3, bucket, prefix, localKey string, log *Log) {
 	defer func() {
 		updateStorage(local.empty(), client, bucket, localKey, log)
 		close(done)
@@ -88,6 +90,9 @@ func storageLoop(ctx context.Context, local *localNode, remotes *remoteNodes, no
 		case <-notify:
 			scan = false
 
+		case <-resync:
+			scan = true
+
 		case <-timer.C:
 			timer.Reset(randomStorageInterval())
 			scan = true
@@ -121,7 +126,31 @@ func updateStorage(local *localNode, client *s3.S3, bucket, key string, log *Log
 	return
 }
 
-func scanStorage(local *localNode, remotes *remoteNodes, reply chan<- []*net.UDPAddr, client *s3.S3, bucket, prefix string, log *Log) (err error) {
+// restoreSeq makes sure that the sequence numbers don't go backwards if the
+// local clock has been adjusted while the service wasn't running.
+func restoreSeq(local *localNode, client *s3.S3, bucket, key string, log *Log) {
+	if client == nil {
+		return
+	}
+
+	output, err := getObject(client, bucket, &key)
+	if err != nil {
+		log.Debugf("S3 GetObject: %s", err)
+		return
+	}
+
+	node := new(Node)
+	err = json.NewDecoder(output.Body).Decode(node)
+	output.Body.Close()
+	if err != nil {
+		log.Errorf("S3: %s: %s", local, err)
+		return
+	}
+
+	local.clock.observe(node.Seq)
+}
+
+func scanStorage(local *localNode, remotes *remoteNodes, reply chan<- []*peerAddr, client *s3.S3, bucket, prefix string, log *Log) (err error) {
 	log.Debug("scanning S3")
 
 	objects, err := listObjects(client, bucket, prefix, log)
@@ -143,7 +172,7 @@ func scanStorage(local *localNode, remotes *remoteNodes, reply chan<- []*net.UDP
 		if ip := net.ParseIP(ipAddr); ip == nil {
 			log.Errorf("bad S3 key: %s", *object.Key)
 			continue
-		} else if !ip.IsGlobalUnicast() {
+		} else if !validUnicast(ip) || ip.String() != ipAddr {
 			log.Errorf("bad IP address in S3: %s", *object.Key)
 			continue
 		}
@@ -167,7 +196,7 @@ func scanStorage(local *localNode, remotes *remoteNodes, reply chan<- []*net.UDP
 		}
 	}
 
-	var newAddrs []*net.UDPAddr
+	var newAddrs []*peerAddr
 
 	for _, key := range loadKeys {
 		ipAddr := (*key)[len(prefix):]
@@ -183,10 +212,37 @@ func scanStorage(local *localNode, remotes *remoteNodes, reply chan<- []*net.UDP
 				continue
 			}
 
+			if node.Version > storageVersion {
+				log.Errorf("S3: %s: unsupported document version: %d", ipAddr, node.Version)
+				continue
+			}
+
+			if node.Id != "" && !validNodeId(node.Id) {
+				log.Errorf("S3: %s: bad node id: %q", ipAddr, node.Id)
+				continue
+			}
+
+			if node.Sig != nil {
+				if err := verifyNodeSignature(node); err != nil {
+					log.Errorf("S3: %s: %s", ipAddr, err)
+					continue
+				}
+			}
+
+			if node.Addrs, err = canonicalIPAddrs(node.Addrs); err != nil {
+				log.Errorf("S3: %s: %s", ipAddr, err)
+				continue
+			}
+
 			node.IPAddr = ipAddr
 			node.TimeNs = output.LastModified.UnixNano()
 
-			if newAddr := remotes.update(node, local, log); newAddr != nil {
+			if err := checkPeerAddrs(local, node); err != nil {
+				log.Errorf("S3: %s", err)
+				continue
+			}
+
+			if newAddr := remotes.update(node, sourceStorage, nil, *output.LastModified, local, log); newAddr != nil {
 				newAddrs = append(newAddrs, newAddr)
 			}
 		} else {
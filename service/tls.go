@@ -0,0 +1,338 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tlsDialTimeout      = time.Second * 5
+	tlsHandshakeTimeout = time.Second * 10
+	tlsWriteTimeout     = time.Second * 10
+
+	// Outgoing connections are closed after this, and incoming connections
+	// after twice this.
+	tlsIdleTimeout = maxTransmitInterval * 3
+
+	tlsQueueLength = 16
+
+	// tlsCloseTimeout limits the time spent flushing the queues on close.
+	tlsCloseTimeout = tlsDialTimeout + tlsWriteTimeout
+)
+
+// loadTLSConfig creates a configuration for mutual authentication.  Peers are
+// contacted using IP addresses, so certificates are verified against the CA
+// without checking names; any certificate issued by the CA is accepted for
+// both client and server roles.
+func loadTLSConfig(certFile, keyFile, caFile string) (config *tls.Config, err error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return
+	}
+
+	caData, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caData) {
+		err = fmt.Errorf("%s: no certificates found", caFile)
+		return
+	}
+
+	config = &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		ClientAuth:         tls.RequireAnyClientCert,
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPeerCertificate(rawCerts, roots)
+		},
+	}
+	return
+}
+
+func verifyPeerCertificate(rawCerts [][]byte, roots *x509.CertPool) (err error) {
+	if len(rawCerts) == 0 {
+		return errors.New("no peer certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	var leaf *x509.Certificate
+
+	for i, raw := range rawCerts {
+		var cert *x509.Certificate
+
+		if cert, err = x509.ParseCertificate(raw); err != nil {
+			return
+		}
+
+		if i == 0 {
+			leaf = cert
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return
+}
+
+type tlsPeer struct {
+	queue chan []byte
+	done  chan struct{}
+}
+
+// tlsTransport carries the same packets as UDP over mutually authenticated
+// TLS connections.  Each packet is prefixed with its length.  Outgoing
+// connections are used only for sending, and incoming ones for receiving.
+type tlsTransport struct {
+	config    *tls.Config
+	listeners []net.Listener
+	log       *Log
+
+	lock   sync.Mutex
+	peers  map[string]*tlsPeer
+	closed bool
+}
+
+func newTLSTransport(config *tls.Config, listeners []net.Listener, log *Log) *tlsTransport {
+	return &tlsTransport{
+		config:    config,
+		listeners: listeners,
+		log:       log,
+		peers:     make(map[string]*tlsPeer),
+	}
+}
+
+// localAddrFor returns the bound address of the listener of the peer's
+// address family, so that connections originate from it like UDP packets do.
+// nil is returned for unspecified addresses.
+func (t *tlsTransport) localAddrFor(addr *net.UDPAddr) net.Addr {
+	for _, listener := range t.listeners {
+		local := listener.Addr().(*net.TCPAddr)
+		if isIPv4(local.IP) == isIPv4(addr.IP) && !local.IP.IsUnspecified() {
+			return &net.TCPAddr{IP: local.IP, Zone: local.Zone}
+		}
+	}
+
+	return nil
+}
+
+func (t *tlsTransport) listen(handler packetHandler, log *Log) {
+	for _, listener := range t.listeners {
+		go t.acceptLoop(listener, handler, log)
+	}
+}
+
+func (t *tlsTransport) acceptLoop(listener net.Listener, handler packetHandler, log *Log) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Error(err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		go t.receiveLoop(tls.Server(conn, t.config), handler, log)
+	}
+}
+
+func (t *tlsTransport) receiveLoop(conn *tls.Conn, handler packetHandler, log *Log) {
+	defer conn.Close()
+
+	tcpAddr := conn.RemoteAddr().(*net.TCPAddr)
+
+	origin := &peerAddr{
+		UDPAddr: &net.UDPAddr{
+			IP:   tcpAddr.IP,
+			Port: tcpAddr.Port,
+			Zone: tcpAddr.Zone,
+		},
+		transport: transportTLS,
+	}
+
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+
+	if err := conn.Handshake(); err != nil {
+		log.Errorf("TLS handshake with %s: %s", tcpAddr.IP, err)
+		return
+	}
+
+	log.Debugf("TLS connection from %s", tcpAddr.IP)
+
+	var header [2]byte
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		conn.SetDeadline(time.Now().Add(tlsIdleTimeout * 2))
+
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			if err != io.EOF {
+				log.Errorf("TLS connection from %s: %s", tcpAddr.IP, err)
+			}
+			return
+		}
+
+		data := buf[:binary.BigEndian.Uint16(header[:])]
+
+		if _, err := io.ReadFull(conn, data); err != nil {
+			log.Errorf("TLS connection from %s: %s", tcpAddr.IP, err)
+			return
+		}
+
+		handler(data, origin)
+	}
+}
+
+// send queues the packet for a background goroutine which maintains the
+// connection to the destination.
+func (t *tlsTransport) send(data []byte, addr *net.UDPAddr) (err error) {
+	if len(data) > maxDatagramSize {
+		return fmt.Errorf("packet is too large: %d bytes", len(data))
+	}
+
+	key := addr.String()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		return errors.New("TLS transport is closed")
+	}
+
+	peer := t.peers[key]
+	if peer == nil {
+		peer = &tlsPeer{
+			queue: make(chan []byte, tlsQueueLength),
+			done:  make(chan struct{}),
+		}
+		t.peers[key] = peer
+
+		go t.sendLoop(key, addr, peer)
+	}
+
+	select {
+	case peer.queue <- data:
+	default:
+		err = fmt.Errorf("TLS queue to %s is full", addr.IP)
+	}
+	return
+}
+
+// sendLoop writes the queued packets to the connection.  It returns when the
+// connection has been idle, or when the queue has been closed and drained.
+func (t *tlsTransport) sendLoop(key string, addr *net.UDPAddr, peer *tlsPeer) {
+	var conn *tls.Conn
+
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+		close(peer.done)
+	}()
+
+	timer := time.NewTimer(tlsIdleTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case data, ok := <-peer.queue:
+			if !ok {
+				return
+			}
+
+			if conn == nil {
+				var err error
+
+				dialer := &net.Dialer{
+					Timeout:   tlsDialTimeout,
+					LocalAddr: t.localAddrFor(addr),
+				}
+
+				if conn, err = tls.DialWithDialer(dialer, "tcp", key, t.config); err != nil {
+					t.log.Errorf("TLS connection to %s: %s", addr.IP, err)
+					conn = nil
+					continue
+				}
+
+				t.log.Debugf("TLS connection to %s", addr.IP)
+			}
+
+			frame := make([]byte, 2+len(data))
+			binary.BigEndian.PutUint16(frame, uint16(len(data)))
+			copy(frame[2:], data)
+
+			conn.SetWriteDeadline(time.Now().Add(tlsWriteTimeout))
+
+			if _, err := conn.Write(frame); err != nil {
+				t.log.Errorf("TLS connection to %s: %s", addr.IP, err)
+				conn.Close()
+				conn = nil
+			}
+
+		case <-timer.C:
+			t.lock.Lock()
+			if len(peer.queue) == 0 {
+				delete(t.peers, key)
+				t.lock.Unlock()
+				return
+			}
+			t.lock.Unlock()
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(tlsIdleTimeout)
+	}
+}
+
+// close stops the listeners, and waits until the queued packets (such as the
+// final state of the node) have been sent, for a limited time.
+func (t *tlsTransport) close() {
+	for _, listener := range t.listeners {
+		listener.Close()
+	}
+
+	t.lock.Lock()
+	t.closed = true
+	peers := t.peers
+	t.peers = nil
+	t.lock.Unlock()
+
+	for _, peer := range peers {
+		close(peer.queue)
+	}
+
+	timeout := time.After(tlsCloseTimeout)
+
+	for _, peer := range peers {
+		select {
+		case <-peer.done:
+		case <-timeout:
+			t.log.Error("TLS queues weren't flushed in time")
+			return
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nameq-service-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := makeTestCert(t, dir, "ca", nil, nil)
+	makeTestCert(t, dir, "node", ca, caKey)
+
+	a := newTestTLSNode(t, dir, "127.0.0.3")
+	defer closeTestLocalNode(a)
+
+	b := newTestTLSNode(t, dir, "127.0.0.2")
+	defer closeTestLocalNode(b)
+
+	value := json.RawMessage("true")
+	a.updateFeatures(map[string]*json.RawMessage{"test": &value})
+
+	remotes := newRemoteNodes(0)
+	notify := make(chan struct{}, 1)
+	reply := make(chan []*peerAddr, 1)
+
+	listenTestPackets(b, remotes, OriginAddress, false, notify, reply)
+
+	transmit(a, []*peerAddr{{
+		UDPAddr:   &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: b.tlsPort},
+		transport: transportTLS,
+		version:   maxProtocolVersion,
+	}}, nil, 0, false, &testLog)
+
+	select {
+	case <-notify:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	addrs := <-reply
+	if addrs[0].transport != transportTLS || addrs[0].Port != a.tlsPort {
+		t.Error(addrs[0], addrs[0].transport)
+	}
+
+	if nodes := remotes.nodes(); len(nodes) != 1 || nodes[0].Features["test"] == nil {
+		t.Error(nodes)
+	}
+}
+
+func TestTLSCloseFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nameq-service-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := makeTestCert(t, dir, "ca", nil, nil)
+	makeTestCert(t, dir, "node", ca, caKey)
+
+	a := newTestTLSNode(t, dir, "127.0.0.3")
+	defer closeTestLocalNode(a)
+
+	b := newTestTLSNode(t, dir, "127.0.0.2")
+	defer closeTestLocalNode(b)
+
+	remotes := newRemoteNodes(0)
+	notify := make(chan struct{}, 1)
+	reply := make(chan []*peerAddr, 1)
+
+	listenTestPackets(b, remotes, OriginAddress, false, notify, reply)
+
+	// The final state is queued, and the connection hasn't even been dialed
+	// yet when the transport is closed.
+	transmit(a.empty(), []*peerAddr{{
+		UDPAddr:   &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: b.tlsPort},
+		transport: transportTLS,
+		version:   maxProtocolVersion,
+	}}, nil, 0, false, &testLog)
+
+	a.tls.close()
+
+	if err := a.tls.send([]byte{0}, &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: b.tlsPort}); err == nil {
+		t.Error("sent after close")
+	}
+
+	select {
+	case <-notify:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	if status := remotes.statuses()["127.0.0.3"]; status == nil || status.Membership != MemberLeft {
+		t.Errorf("%#v", status)
+	}
+}
+
+func TestTLSForeignCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nameq-service-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := makeTestCert(t, dir, "ca", nil, nil)
+	foreignCA, foreignKey := makeTestCert(t, dir, "foreign-ca", nil, nil)
+	node, _ := makeTestCert(t, dir, "node", ca, caKey)
+	foreign, _ := makeTestCert(t, dir, "foreign", foreignCA, foreignKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	if err := verifyPeerCertificate([][]byte{node.Raw}, roots); err != nil {
+		t.Error(err)
+	}
+
+	if err := verifyPeerCertificate([][]byte{foreign.Raw}, roots); err == nil {
+		t.Error("foreign certificate accepted")
+	}
+}
+
+// newTestTLSNode binds to ephemeral ports on a loopback address, and advertises
+// them.  All IPv4 peers are contacted using TLS.
+func newTestTLSNode(t *testing.T, dir, ipAddr string) *localNode {
+	local, err := newLocalNode(&Params{
+		Addr:        ipAddr,
+		SendMode:    testMode,
+		TLSCertFile: filepath.Join(dir, "node.crt"),
+		TLSKeyFile:  filepath.Join(dir, "node.key"),
+		TLSCAFile:   filepath.Join(dir, "ca.crt"),
+		TLSPeers:    []string{"0.0.0.0/0"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local.port = local.udp.conns[0].LocalAddr().(*net.UDPAddr).Port
+	local.tlsPort = local.tls.listeners[0].Addr().(*net.TCPAddr).Port
+
+	return local
+}
+
+// makeTestCert writes NAME.crt and NAME.key.  The certificate is
+// self-signed if parent is nil.
+func makeTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestPEM(t, filepath.Join(dir, name+".crt"), "CERTIFICATE", der)
+	writeTestPEM(t, filepath.Join(dir, name+".key"), "EC PRIVATE KEY", keyDER)
+
+	return cert, key
+}
+
+func writeTestPEM(t *testing.T, filename, blockType string, data []byte) {
+	if err := ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
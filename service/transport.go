@@ -0,0 +1,106 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// transportKind identifies the transport used with a peer.
+type transportKind int
+
+const (
+	transportUDP transportKind = iota
+	transportTLS
+	transportMulticast
+)
+
+func (kind transportKind) String() string {
+	switch kind {
+	case transportUDP:
+		return "udp"
+
+	case transportTLS:
+		return "tls"
+
+	case transportMulticast:
+		return "multicast"
+
+	default:
+		return fmt.Sprintf("transport-%d", int(kind))
+	}
+}
+
+// packetHandler is invoked for each received packet.  The data must not be
+// retained.
+type packetHandler func(data []byte, origin *peerAddr)
+
+// transport carries packets between nodes.
+type transport interface {
+	// listen delivers received packets to the handler in the background.
+	listen(handler packetHandler, log *Log)
+
+	send(data []byte, addr *net.UDPAddr) error
+
+	close()
+}
+
+// udpTransport is the default transport.  It has a socket for each address
+// family.
+type udpTransport struct {
+	conns []*net.UDPConn
+}
+
+// connFor finds a socket of the same address family as the destination.
+func (t *udpTransport) connFor(addr *net.UDPAddr) *net.UDPConn {
+	for _, conn := range t.conns {
+		if isIPv4(conn.LocalAddr().(*net.UDPAddr).IP) == isIPv4(addr.IP) {
+			return conn
+		}
+	}
+
+	return nil
+}
+
+func (t *udpTransport) listen(handler packetHandler, log *Log) {
+	for _, conn := range t.conns {
+		go receiveUDP(conn, handler, log)
+	}
+}
+
+func receiveUDP(conn *net.UDPConn, handler packetHandler, log *Log) {
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, originAddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Error(err)
+			continue
+		}
+
+		handler(buf[:n], &peerAddr{
+			UDPAddr:   originAddr,
+			transport: transportUDP,
+		})
+	}
+}
+
+func (t *udpTransport) send(data []byte, addr *net.UDPAddr) (err error) {
+	conn := t.connFor(addr)
+	if conn == nil {
+		err = fmt.Errorf("no socket for sending to %s", addr.IP)
+		return
+	}
+
+	_, err = conn.WriteToUDP(data, addr)
+	return
+}
+
+func (t *udpTransport) close() {
+	for _, conn := range t.conns {
+		conn.Close()
+	}
+}